@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// actionLocks serializes actions on the same entity so on and off commands
+// never run concurrently
+var (
+	actionLocksMu sync.Mutex
+	actionLocks   = make(map[string]*sync.Mutex)
+)
+
+// commandTopic returns the topic Home Assistant publishes commands for an entity to
+func commandTopic(cmd CommandConfig, clientID string) string {
+	return fmt.Sprintf("%s/%s/%s/set", topicSettings.prefix, componentOf(cmd), sensorID(cmd, clientID))
+}
+
+// hasCommandTopic reports whether an entity accepts commands from Home Assistant
+func hasCommandTopic(cmd CommandConfig) bool {
+	switch componentOf(cmd) {
+	case ComponentSwitch, ComponentButton, ComponentNumber, ComponentSelect:
+		return true
+	}
+	return false
+}
+
+// SubscribeCommandTopic subscribes to an entity's command topic and runs the
+// matching command whenever Home Assistant publishes to it
+func SubscribeCommandTopic(cmd CommandConfig, clientID string) {
+	topic := commandTopic(cmd, clientID)
+
+	subscribeMQTT(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		// A retained command would be re-run on every reconnect
+		if msg.Retained() {
+			logger.Warnf("Ignoring retained command for %s on %s", cmd.Name, msg.Topic())
+			return
+		}
+		// Commands can run for a long time, don't block the client's message handling
+		switch componentOf(cmd) {
+		case ComponentButton:
+			go handleButtonPress(cmd, clientID)
+		case ComponentNumber, ComponentSelect:
+			go handleSetValue(cmd, clientID, string(msg.Payload()))
+		default:
+			go handleSwitchCommand(cmd, clientID, string(msg.Payload()))
+		}
+	})
+
+	logger.Debugf("Listening for %s commands on %s", cmd.Name, topic)
+}
+
+// handleSwitchCommand runs command_on or command_off for a switch and
+// publishes its new state
+func handleSwitchCommand(cmd CommandConfig, clientID string, payload string) {
+	var command, state string
+	switch payload {
+	case payloadOn(cmd):
+		command, state = cmd.CommandOn, payloadOn(cmd)
+	case payloadOff(cmd):
+		command, state = cmd.CommandOff, payloadOff(cmd)
+	default:
+		logger.Warnf("Ignoring unknown payload %q for switch %s", payload, cmd.Name)
+		return
+	}
+
+	lock := actionLock(cmd, clientID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Infof("Turning switch %s %s", cmd.Name, state)
+	result := RunCommand(cmd, command)
+	if result.Err != nil {
+		logger.Errorf("Failed to turn switch %s %s: %v", cmd.Name, state, result.Err)
+	}
+
+	publishActionState(cmd, clientID, result, state)
+}
+
+// handleButtonPress runs a button's command and, if configured, publishes
+// its output to the result sensor. Presses while the command is still
+// running are ignored.
+func handleButtonPress(cmd CommandConfig, clientID string) {
+	lock := actionLock(cmd, clientID)
+	if !lock.TryLock() {
+		logger.Warnf("Ignoring press of %s, the previous run is still in progress", cmd.Name)
+		return
+	}
+	defer lock.Unlock()
+
+	logger.Infof("Button %s pressed", cmd.Name)
+	result := RunCommand(cmd, cmd.Command)
+	if result.Err != nil {
+		logger.Errorf("Button %s failed: %v", cmd.Name, result.Err)
+	} else {
+		logger.Infof("Button %s finished in %s", cmd.Name, result.Duration.Round(time.Millisecond))
+	}
+
+	if hasResultSensor(cmd) {
+		PublishResult(resultSensor(cmd), result.State, clientID)
+	}
+}
+
+// handleSetValue runs command_set for a number or select with the value
+// chosen in Home Assistant and publishes the new value
+func handleSetValue(cmd CommandConfig, clientID string, payload string) {
+	value, err := parseValue(cmd, payload)
+	if err != nil {
+		logger.Warnf("Ignoring value for %s: %v", cmd.Name, err)
+		return
+	}
+
+	lock := actionLock(cmd, clientID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	logger.Infof("Setting %s to %s", cmd.Name, value)
+	result := RunCommand(cmd, valueCommand(cmd, value))
+	if result.Err != nil {
+		logger.Errorf("Failed to set %s to %s: %v", cmd.Name, value, result.Err)
+	}
+
+	publishActionState(cmd, clientID, result, value)
+}
+
+// publishActionState publishes an entity's state after an action. The real
+// state is read back with command_state when there is one; otherwise the
+// action is assumed to have produced expected if it succeeded. The caller
+// must hold the entity's action lock.
+func publishActionState(cmd CommandConfig, clientID string, result CommandResult, expected string) {
+	if cmd.CommandState != "" {
+		ExecuteCommand(cmd, clientID)
+	} else if result.Err == nil {
+		PublishResult(cmd, expected, clientID)
+	}
+}
+
+// actionLock returns the lock serializing actions on an entity
+func actionLock(cmd CommandConfig, clientID string) *sync.Mutex {
+	actionLocksMu.Lock()
+	defer actionLocksMu.Unlock()
+
+	id := sensorID(cmd, clientID)
+	lock, exists := actionLocks[id]
+	if !exists {
+		lock = &sync.Mutex{}
+		actionLocks[id] = lock
+	}
+	return lock
+}
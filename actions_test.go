@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// useTestOfflineBuffer swaps in an empty offline buffer for the test
+func useTestOfflineBuffer(t *testing.T) {
+	t.Helper()
+
+	previous := offlineBuffer
+	offlineBuffer = NewOfflineBuffer(OfflineBufferConfig{})
+	t.Cleanup(func() { offlineBuffer = previous })
+}
+
+func TestPublishActionState(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("command_state uses a POSIX shell")
+	}
+	quietLogger(t)
+
+	withReadBack := CommandConfig{Name: "Fan", Component: ComponentNumber, CommandSet: "set {value}", CommandState: "echo 40"}
+	assumed := CommandConfig{Name: "Fan", Component: ComponentNumber, CommandSet: "set {value}"}
+	topic := stateTopic(assumed, "cmd")
+
+	tests := []struct {
+		name   string
+		cmd    CommandConfig
+		result CommandResult
+		want   []string
+	}{
+		{"read back", withReadBack, CommandResult{}, []string{topic + "=40"}},
+		{"read back after a failure", withReadBack, CommandResult{Err: errors.New("exit status 1")}, []string{topic + "=40"}},
+		{"assumed after success", assumed, CommandResult{}, []string{topic + "=50"}},
+		{"nothing after a failure", assumed, CommandResult{Err: errors.New("exit status 1")}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeMQTTClient{connected: true}
+			useFakeMQTTClient(t, client)
+			useTestOfflineBuffer(t)
+
+			publishActionState(tt.cmd, "cmd", tt.result, "50")
+			if !reflect.DeepEqual(client.published, tt.want) {
+				t.Errorf("published = %q, want %q", client.published, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecutePeriodicRunSkipsDuringAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("command_state uses a POSIX shell")
+	}
+	quietLogger(t)
+
+	client := &fakeMQTTClient{connected: true}
+	useFakeMQTTClient(t, client)
+	useTestOfflineBuffer(t)
+
+	cmd := CommandConfig{Name: "Pump", Component: ComponentSwitch,
+		CommandOn: "true", CommandOff: "true", CommandState: "true"}
+
+	// While an action holds the lock, the scheduled read is skipped
+	lock := actionLock(cmd, "cmd")
+	lock.Lock()
+	executePeriodicRun(cmd, "cmd")
+	lock.Unlock()
+	if len(client.published) != 0 {
+		t.Fatalf("published %q during an action, want nothing", client.published)
+	}
+
+	executePeriodicRun(cmd, "cmd")
+	if want := []string{stateTopic(cmd, "cmd") + "=" + defaultPayloadOn}; !reflect.DeepEqual(client.published, want) {
+		t.Errorf("published = %q, want %q", client.published, want)
+	}
+	if !lock.TryLock() {
+		t.Fatal("executePeriodicRun() left the action lock held")
+	}
+	lock.Unlock()
+}
@@ -37,6 +37,7 @@ EOF
 # Add SSH configuration if present
 if bashio::config.exists 'ssh.hosts'; then
     echo "ssh:" >> "${CONFIG_PATH}"
+    echo "  state_dir: \"/data\"" >> "${CONFIG_PATH}"
     echo "  hosts:" >> "${CONFIG_PATH}"
 
     # Parse SSH hosts from JSON array
@@ -48,6 +49,9 @@ if bashio::config.exists 'ssh.hosts'; then
         key_path=$(bashio::config "ssh.hosts[${host}].key_path" "")
         password=$(bashio::config "ssh.hosts[${host}].password" "")
         timeout=$(bashio::config "ssh.hosts[${host}].timeout" "30s")
+        known_hosts=$(bashio::config "ssh.hosts[${host}].known_hosts" "/data/known_hosts")
+        host_key_verification=$(bashio::config "ssh.hosts[${host}].host_key_verification" "tofu")
+        host_key_fingerprint=$(bashio::config "ssh.hosts[${host}].host_key_fingerprint" "")
 
         cat >> "${CONFIG_PATH}" << EOF
     - name: "${name}"
@@ -65,6 +69,12 @@ EOF
         fi
 
         echo "      timeout: \"${timeout}\"" >> "${CONFIG_PATH}"
+        echo "      known_hosts: \"${known_hosts}\"" >> "${CONFIG_PATH}"
+        echo "      host_key_verification: \"${host_key_verification}\"" >> "${CONFIG_PATH}"
+
+        if [ -n "${host_key_fingerprint}" ]; then
+            echo "      host_key_fingerprint: \"${host_key_fingerprint}\"" >> "${CONFIG_PATH}"
+        fi
     done
 fi
 
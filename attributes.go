@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Run details that can be published as attributes
+const (
+	AttributeExitCode  = "exit_code"
+	AttributeDuration  = "duration"
+	AttributeHost      = "host"
+	AttributeTimestamp = "timestamp"
+	AttributeStderr    = "stderr"
+	AttributeError     = "error"
+)
+
+// stderrExcerptLength caps the stderr published as an attribute
+const stderrExcerptLength = 1024
+
+// hasAttributes reports whether a command publishes a JSON attributes topic
+func hasAttributes(cmd CommandConfig) bool {
+	return len(cmd.Attributes) > 0 || len(cmd.JSONAttributes) > 0
+}
+
+// validateAttributes checks a command's attribute names
+func validateAttributes(cmd CommandConfig) error {
+	for _, attribute := range cmd.Attributes {
+		switch attribute {
+		case AttributeExitCode, AttributeDuration, AttributeHost, AttributeTimestamp, AttributeStderr, AttributeError:
+		default:
+			return fmt.Errorf("command %s: unknown attribute %q", cmd.Name, attribute)
+		}
+	}
+	return nil
+}
+
+// commandAttributes builds the attributes payload for a run of a command.
+// JSON attributes whose path isn't in the output are left out.
+func commandAttributes(cmd CommandConfig, result CommandResult) (string, error) {
+	attributes := make(map[string]interface{})
+
+	for _, attribute := range cmd.Attributes {
+		switch attribute {
+		case AttributeExitCode:
+			attributes[attribute] = result.ExitCode
+		case AttributeDuration:
+			attributes[attribute] = result.Duration.Round(time.Millisecond).Seconds()
+		case AttributeHost:
+			attributes[attribute] = commandHost(cmd)
+		case AttributeTimestamp:
+			attributes[attribute] = time.Now().Format(time.RFC3339)
+		case AttributeStderr:
+			attributes[attribute] = excerpt(result.Stderr, stderrExcerptLength)
+		case AttributeError:
+			attributes[attribute] = ""
+			if result.Err != nil {
+				attributes[attribute] = result.Err.Error()
+			}
+		}
+	}
+
+	if len(cmd.JSONAttributes) > 0 {
+		data, err := decodeJSON(result.Stdout)
+		if err != nil {
+			logger.Debugf("Output of %s is not JSON, skipping JSON attributes: %v", cmd.Name, err)
+		}
+		for name, path := range cmd.JSONAttributes {
+			if data == nil {
+				break
+			}
+			value, err := lookupJSONPath(data, path)
+			if err != nil {
+				logger.Debugf("Skipping attribute %s of %s: %v", name, cmd.Name, err)
+				continue
+			}
+			attributes[name] = value
+		}
+	}
+
+	payload, err := json.Marshal(attributes)
+	if err != nil {
+		return "", err
+	}
+	return string(payload), nil
+}
+
+// commandHost returns the host a command runs on
+func commandHost(cmd CommandConfig) string {
+	if cmd.TargetHost == "" {
+		return "local"
+	}
+	return cmd.TargetHost
+}
+
+// excerpt shortens s to at most limit bytes, keeping the end where errors usually are
+func excerpt(s string, limit int) string {
+	if len(s) <= limit {
+		return s
+	}
+	cut := len(s) - limit
+	// Don't split a UTF-8 sequence
+	for cut < len(s) && s[cut]&0xC0 == 0x80 {
+		cut++
+	}
+	return "..." + s[cut:]
+}
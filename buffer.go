@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Drop policies for OfflineBufferConfig.DropPolicy
+const (
+	DropOldest = "oldest"
+	DropNewest = "newest"
+)
+
+// defaultOfflineBufferSize is the number of results kept per sensor while disconnected
+const defaultOfflineBufferSize = 10
+
+// publishTimeout bounds how long a publish waits for the broker, so a stalled
+// ack queues the result instead of blocking every publisher
+const publishTimeout = 10 * time.Second
+
+// bufferedMessage is a state publish held back while the broker is unreachable
+type bufferedMessage struct {
+	Key      string    `json:"key"`
+	Topic    string    `json:"topic"`
+	Payload  string    `json:"payload"`
+	QueuedAt time.Time `json:"queued_at"`
+
+	seq uint64 // queue order, used to drop flushed messages
+}
+
+// OfflineBuffer holds state publishes made while the broker is down and
+// flushes them in order on reconnect. Each sensor keeps at most size
+// messages; when full, the drop policy decides whether the oldest queued
+// message or the new one is discarded. mu only guards the queue and is never
+// held while talking to the broker.
+type OfflineBuffer struct {
+	mu         sync.Mutex
+	messages   []bufferedMessage
+	nextSeq    uint64
+	flushing   bool
+	size       int
+	dropPolicy string
+	file       string
+}
+
+var offlineBuffer = NewOfflineBuffer(OfflineBufferConfig{})
+
+// NewOfflineBuffer creates a buffer from configuration, loading any messages
+// persisted to its file by a previous run
+func NewOfflineBuffer(config OfflineBufferConfig) *OfflineBuffer {
+	buffer := &OfflineBuffer{
+		size:       config.Size,
+		dropPolicy: strings.ToLower(config.DropPolicy),
+		file:       config.File,
+	}
+
+	if buffer.size == 0 {
+		buffer.size = defaultOfflineBufferSize
+	}
+	if buffer.dropPolicy == "" {
+		buffer.dropPolicy = DropOldest
+	}
+	if buffer.dropPolicy != DropOldest && buffer.dropPolicy != DropNewest {
+		logger.Warnf("Unknown offline buffer drop policy '%s', defaulting to %s", config.DropPolicy, DropOldest)
+		buffer.dropPolicy = DropOldest
+	}
+
+	if buffer.file != "" {
+		buffer.load()
+	}
+
+	return buffer
+}
+
+// Publish sends a message now if connected, first draining anything queued
+// ahead of it, otherwise queues it. It returns true if the message was sent.
+func (b *OfflineBuffer) Publish(key, topic, payload string) bool {
+	if mqttClient.IsConnectionOpen() {
+		b.Flush()
+
+		b.mu.Lock()
+		// Anything still queued, or being flushed by another caller, goes first
+		blocked := len(b.messages) > 0 || b.flushing
+		b.mu.Unlock()
+
+		if !blocked {
+			err := publishMessage(topic, payload)
+			if err == nil {
+				return true
+			}
+			logger.Warnf("Failed to publish to %s: %v", topic, err)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.enqueueLocked(bufferedMessage{Key: key, Topic: topic, Payload: payload, QueuedAt: time.Now()})
+	return false
+}
+
+// Flush publishes queued messages in order, stopping at the first failure.
+// Only one flush runs at a time; a concurrent call returns straight away.
+func (b *OfflineBuffer) Flush() {
+	b.mu.Lock()
+	if b.flushing || len(b.messages) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	b.flushing = true
+	pending := append([]bufferedMessage(nil), b.messages...)
+	b.mu.Unlock()
+
+	logger.Infof("Flushing %d buffered MQTT message(s)", len(pending))
+
+	var lastSent uint64
+	sent := false
+	for _, message := range pending {
+		if err := publishMessage(message.Topic, message.Payload); err != nil {
+			logger.Warnf("Failed to flush buffered message to %s: %v", message.Topic, err)
+			break
+		}
+		lastSent = message.seq
+		sent = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.flushing = false
+	if sent {
+		// Messages may have been queued or dropped meanwhile, so remove the
+		// sent ones by their place in the queue rather than by count
+		remaining := b.messages[:0]
+		for _, message := range b.messages {
+			if message.seq > lastSent {
+				remaining = append(remaining, message)
+			}
+		}
+		b.messages = remaining
+		b.saveLocked()
+	}
+
+	if len(b.messages) > 0 {
+		logger.Warnf("%d buffered MQTT message(s) still pending", len(b.messages))
+	}
+}
+
+// publishMessage publishes a state and waits at most publishTimeout for the broker
+func publishMessage(topic, payload string) error {
+	token := mqttClient.Publish(topic, 0, false, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timed out after %s", publishTimeout)
+	}
+	return token.Error()
+}
+
+// enqueueLocked adds a message, applying the per-key limit; b.mu must be held
+func (b *OfflineBuffer) enqueueLocked(message bufferedMessage) {
+	if b.size < 0 {
+		logger.Warnf("MQTT broker unavailable, dropping result for %s (offline buffer disabled)", message.Topic)
+		return
+	}
+
+	count := 0
+	oldest := -1
+	for i, queued := range b.messages {
+		if queued.Key == message.Key {
+			if oldest < 0 {
+				oldest = i
+			}
+			count++
+		}
+	}
+
+	if count >= b.size {
+		if b.dropPolicy == DropNewest {
+			logger.Warnf("Offline buffer full for %s, dropping new result", message.Topic)
+			return
+		}
+		logger.Debugf("Offline buffer full for %s, dropping oldest result", message.Topic)
+		b.messages = append(b.messages[:oldest], b.messages[oldest+1:]...)
+	}
+
+	b.nextSeq++
+	message.seq = b.nextSeq
+	b.messages = append(b.messages, message)
+	logger.Debugf("Buffered result for %s while MQTT broker is unavailable (%d queued)", message.Topic, len(b.messages))
+	b.saveLocked()
+}
+
+// saveLocked persists the queue to disk if a file is configured; b.mu must be held
+func (b *OfflineBuffer) saveLocked() {
+	if b.file == "" {
+		return
+	}
+
+	if len(b.messages) == 0 {
+		if err := os.Remove(b.file); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("Failed to remove offline buffer file %s: %v", b.file, err)
+		}
+		return
+	}
+
+	data, err := json.Marshal(b.messages)
+	if err != nil {
+		logger.Errorf("Failed to marshal offline buffer: %v", err)
+		return
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated buffer
+	tmpFile := b.file + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0600); err != nil {
+		logger.Errorf("Failed to write offline buffer file %s: %v", tmpFile, err)
+		return
+	}
+	if err := os.Rename(tmpFile, b.file); err != nil {
+		logger.Errorf("Failed to replace offline buffer file %s: %v", b.file, err)
+	}
+}
+
+// load reads messages persisted by a previous run
+func (b *OfflineBuffer) load() {
+	data, err := os.ReadFile(b.file)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logger.Errorf("Failed to read offline buffer file %s: %v", b.file, err)
+		return
+	}
+
+	if err := json.Unmarshal(data, &b.messages); err != nil {
+		logger.Errorf("Failed to parse offline buffer file %s: %v", b.file, err)
+		b.messages = nil
+		return
+	}
+
+	for i := range b.messages {
+		b.nextSeq++
+		b.messages[i].seq = b.nextSeq
+	}
+
+	logger.Infof("Loaded %d buffered MQTT message(s) from %s", len(b.messages), b.file)
+}
+
+// String describes the buffer configuration for logging
+func (b *OfflineBuffer) String() string {
+	if b.size < 0 {
+		return "disabled"
+	}
+	description := fmt.Sprintf("%d per sensor, drop %s", b.size, b.dropPolicy)
+	if b.file != "" {
+		description += ", persisted to " + b.file
+	}
+	return description
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeToken is an MQTT token that has completed, or never will if stalled
+type fakeToken struct {
+	err     error
+	stalled bool
+}
+
+func (t *fakeToken) Wait() bool                     { return !t.stalled }
+func (t *fakeToken) WaitTimeout(time.Duration) bool { return !t.stalled }
+func (t *fakeToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (t *fakeToken) Error() error { return t.err }
+
+// fakeMQTTClient records publishes; the embedded interface panics on any
+// method the buffer is not expected to call
+type fakeMQTTClient struct {
+	mqtt.Client
+	connected  bool
+	failTopic  string
+	stallTopic string
+	published  []string
+	onPublish  func()
+}
+
+func (c *fakeMQTTClient) IsConnectionOpen() bool { return c.connected }
+
+func (c *fakeMQTTClient) Publish(topic string, _ byte, _ bool, payload interface{}) mqtt.Token {
+	if c.onPublish != nil {
+		c.onPublish()
+	}
+	if topic == c.failTopic {
+		return &fakeToken{err: errors.New("publish failed")}
+	}
+	if topic == c.stallTopic {
+		return &fakeToken{stalled: true}
+	}
+	c.published = append(c.published, topic+"="+payload.(string))
+	return &fakeToken{}
+}
+
+func useFakeMQTTClient(t *testing.T, client *fakeMQTTClient) {
+	t.Helper()
+
+	previous := mqttClient
+	mqttClient = client
+	t.Cleanup(func() { mqttClient = previous })
+}
+
+func TestOfflineBufferPublishDrainsQueueWhileConnected(t *testing.T) {
+	quietLogger(t)
+
+	client := &fakeMQTTClient{}
+	useFakeMQTTClient(t, client)
+
+	buffer := NewOfflineBuffer(OfflineBufferConfig{Size: 2})
+
+	// Disconnected: results are queued
+	if buffer.Publish("a", "state/a", "1") {
+		t.Fatal("Publish() while disconnected reported the message as sent")
+	}
+	buffer.Publish("b", "state/b", "1")
+
+	// Connected: the queue is drained in order before the new result
+	client.connected = true
+	if !buffer.Publish("a", "state/a", "2") {
+		t.Fatal("Publish() while connected did not send the message")
+	}
+
+	want := []string{"state/a=1", "state/b=1", "state/a=2"}
+	if !reflect.DeepEqual(client.published, want) {
+		t.Errorf("published = %q, want %q", client.published, want)
+	}
+	if len(buffer.messages) != 0 {
+		t.Errorf("%d message(s) still queued, want 0", len(buffer.messages))
+	}
+}
+
+func TestOfflineBufferPublishKeepsOrderAfterFailedFlush(t *testing.T) {
+	quietLogger(t)
+
+	client := &fakeMQTTClient{failTopic: "state/b"}
+	useFakeMQTTClient(t, client)
+
+	buffer := NewOfflineBuffer(OfflineBufferConfig{Size: 2})
+	buffer.Publish("a", "state/a", "1")
+	buffer.Publish("b", "state/b", "1")
+	client.connected = true
+
+	// The flush stops at the failing message, so the new result queues behind it
+	if buffer.Publish("c", "state/c", "1") {
+		t.Fatal("Publish() sent a message ahead of a queued one")
+	}
+	if want := []string{"state/a=1"}; !reflect.DeepEqual(client.published, want) {
+		t.Errorf("published = %q, want %q", client.published, want)
+	}
+
+	// Once the broker accepts it again, the next publish drains everything
+	client.failTopic = ""
+	if !buffer.Publish("c", "state/c", "2") {
+		t.Fatal("Publish() did not send the message after the queue drained")
+	}
+
+	want := []string{"state/a=1", "state/b=1", "state/c=1", "state/c=2"}
+	if !reflect.DeepEqual(client.published, want) {
+		t.Errorf("published = %q, want %q", client.published, want)
+	}
+}
+
+func TestOfflineBufferPublishQueuesOnStalledAck(t *testing.T) {
+	quietLogger(t)
+
+	client := &fakeMQTTClient{connected: true, stallTopic: "state/a"}
+	useFakeMQTTClient(t, client)
+
+	buffer := NewOfflineBuffer(OfflineBufferConfig{Size: 2})
+	if buffer.Publish("a", "state/a", "1") {
+		t.Fatal("Publish() reported a message whose ack never arrived as sent")
+	}
+	if len(buffer.messages) != 1 {
+		t.Fatalf("%d message(s) queued, want 1", len(buffer.messages))
+	}
+
+	client.stallTopic = ""
+	buffer.Flush()
+	if want := []string{"state/a=1"}; !reflect.DeepEqual(client.published, want) {
+		t.Errorf("published = %q, want %q", client.published, want)
+	}
+}
+
+func TestOfflineBufferUnlockedWhilePublishing(t *testing.T) {
+	quietLogger(t)
+
+	client := &fakeMQTTClient{}
+	useFakeMQTTClient(t, client)
+
+	buffer := NewOfflineBuffer(OfflineBufferConfig{Size: 2})
+	buffer.Publish("a", "state/a", "1")
+
+	client.connected = true
+	client.onPublish = func() {
+		if !buffer.mu.TryLock() {
+			t.Error("buffer lock held while publishing")
+			return
+		}
+		buffer.mu.Unlock()
+	}
+	buffer.Publish("b", "state/b", "1")
+
+	if want := []string{"state/a=1", "state/b=1"}; !reflect.DeepEqual(client.published, want) {
+		t.Errorf("published = %q, want %q", client.published, want)
+	}
+}
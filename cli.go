@@ -8,6 +8,9 @@ import (
 	"github.com/spf13/viper"
 )
 
+// version is the application version reported by --version and in device metadata
+const version = "1.0.0"
+
 // CLIConfig holds command line configuration
 type CLIConfig struct {
 	ConfigFile string
@@ -41,7 +44,7 @@ func ParseFlags() *CLIConfig {
 
 		// Handle version flag
 		if arg == "-v" || arg == "--version" {
-			fmt.Println("HA Command to MQTT v1.0.0")
+			fmt.Printf("HA Command to MQTT v%s\n", version)
 			os.Exit(0)
 		}
 
@@ -100,7 +103,7 @@ func ParseFlags() *CLIConfig {
 }
 
 func printUsage() {
-	fmt.Println("HA Command to MQTT v1.0.0 - Execute commands and publish results to MQTT for Home Assistant")
+	fmt.Printf("HA Command to MQTT v%s - Execute commands and publish results to MQTT for Home Assistant\n", version)
 	fmt.Println("")
 	fmt.Println("Usage:")
 	fmt.Printf("  %s [OPTIONS]\n", os.Args[0])
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Home Assistant entity types a command can be exposed as
+const (
+	ComponentSensor       = "sensor"
+	ComponentBinarySensor = "binary_sensor"
+	ComponentSwitch       = "switch"
+	ComponentButton       = "button"
+	ComponentNumber       = "number"
+	ComponentSelect       = "select"
+)
+
+// valuePlaceholder is replaced with the chosen value in command_set
+const valuePlaceholder = "{value}"
+
+// Default payloads published for binary sensors
+const (
+	defaultPayloadOn  = "ON"
+	defaultPayloadOff = "OFF"
+)
+
+// patterns caches compiled regular expressions by their source
+var patterns sync.Map
+
+// compilePattern compiles a regular expression once and reuses it afterwards
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(pattern, re)
+	return re, nil
+}
+
+// componentOf returns the Home Assistant component of a command, defaulting to sensor
+func componentOf(cmd CommandConfig) string {
+	if cmd.Component == "" {
+		return ComponentSensor
+	}
+	return cmd.Component
+}
+
+// validateComponent checks the component specific settings of a command
+func validateComponent(cmd CommandConfig) error {
+	if err := cmd.ValueExtractor.validate(); err != nil {
+		return fmt.Errorf("command %s: %v", cmd.Name, err)
+	}
+	if err := validateSensors(cmd); err != nil {
+		return err
+	}
+	if err := validateAttributes(cmd); err != nil {
+		return err
+	}
+	if err := validateFailurePolicy(cmd); err != nil {
+		return err
+	}
+
+	switch componentOf(cmd) {
+	case ComponentSensor:
+	case ComponentButton:
+		if cmd.Command == "" {
+			return fmt.Errorf("command %s: a button needs a command", cmd.Name)
+		}
+	case ComponentNumber:
+		if !strings.Contains(cmd.CommandSet, valuePlaceholder) {
+			return fmt.Errorf("command %s: a number needs a command_set containing %s", cmd.Name, valuePlaceholder)
+		}
+		if cmd.Min != nil && cmd.Max != nil && *cmd.Min > *cmd.Max {
+			return fmt.Errorf("command %s: min is greater than max", cmd.Name)
+		}
+		if cmd.Step != nil && *cmd.Step <= 0 {
+			return fmt.Errorf("command %s: step must be positive", cmd.Name)
+		}
+	case ComponentSelect:
+		if !strings.Contains(cmd.CommandSet, valuePlaceholder) {
+			return fmt.Errorf("command %s: a select needs a command_set containing %s", cmd.Name, valuePlaceholder)
+		}
+		if len(cmd.Options) == 0 {
+			return fmt.Errorf("command %s: a select needs options", cmd.Name)
+		}
+	case ComponentSwitch:
+		if cmd.CommandOn == "" || cmd.CommandOff == "" {
+			return fmt.Errorf("command %s: a switch needs both command_on and command_off", cmd.Name)
+		}
+		fallthrough
+	case ComponentBinarySensor:
+		if cmd.OnMatch != "" {
+			if _, err := compilePattern(cmd.OnMatch); err != nil {
+				return fmt.Errorf("command %s: invalid on_match pattern: %v", cmd.Name, err)
+			}
+		}
+	default:
+		return fmt.Errorf("command %s: unsupported component %q", cmd.Name, cmd.Component)
+	}
+	return nil
+}
+
+// validateSensors checks the sensors derived from a command's output
+func validateSensors(cmd CommandConfig) error {
+	if len(cmd.Sensors) == 0 {
+		return nil
+	}
+	if componentOf(cmd) != ComponentSensor {
+		return fmt.Errorf("command %s: sensors can only be used with the sensor component", cmd.Name)
+	}
+	if cmd.ValueExtractor.hasExtractor() {
+		return fmt.Errorf("command %s: set value_json, value_regex or value_template on each of the sensors instead", cmd.Name)
+	}
+
+	names := make(map[string]bool)
+	for _, sensor := range cmd.Sensors {
+		if sensor.Name == "" {
+			return fmt.Errorf("command %s: every sensor needs a name", cmd.Name)
+		}
+		if names[sanitizeName(sensor.Name)] {
+			return fmt.Errorf("command %s: duplicate sensor %s", cmd.Name, sensor.Name)
+		}
+		names[sanitizeName(sensor.Name)] = true
+
+		if err := sensor.ValueExtractor.validate(); err != nil {
+			return fmt.Errorf("command %s: sensor %s: %v", cmd.Name, sensor.Name, err)
+		}
+	}
+	return nil
+}
+
+// entities returns the Home Assistant entities fed by a command: one per
+// entry in sensors, or the command itself
+func entities(cmd CommandConfig) []CommandConfig {
+	if len(cmd.Sensors) == 0 {
+		return []CommandConfig{cmd}
+	}
+
+	derived := make([]CommandConfig, 0, len(cmd.Sensors))
+	for _, sensor := range cmd.Sensors {
+		entity := cmd
+		entity.Sensors = nil
+		entity.Name = sensor.Name
+		entity.ValueExtractor = sensor.ValueExtractor
+		if sensor.DeviceClass != "" {
+			entity.DeviceClass = sensor.DeviceClass
+		}
+		if sensor.Unit != "" {
+			entity.Unit = sensor.Unit
+		}
+		if sensor.Icon != "" {
+			entity.Icon = sensor.Icon
+		}
+		if sensor.StateClass != "" {
+			entity.StateClass = sensor.StateClass
+		}
+		if sensor.EntityCategory != "" {
+			entity.EntityCategory = sensor.EntityCategory
+		}
+		derived = append(derived, entity)
+	}
+	return derived
+}
+
+// stateCommand returns the command run periodically to read an entity's
+// state, or "" if the entity has none
+func stateCommand(cmd CommandConfig) string {
+	switch componentOf(cmd) {
+	case ComponentSwitch, ComponentNumber, ComponentSelect:
+		return cmd.CommandState
+	case ComponentButton:
+		return ""
+	}
+	return cmd.Command
+}
+
+// hasResultSensor reports whether a button publishes the output of its last run
+func hasResultSensor(cmd CommandConfig) bool {
+	return componentOf(cmd) == ComponentButton && cmd.ResultSensor
+}
+
+// resultSensor returns the sensor showing the output of a button's last run
+func resultSensor(cmd CommandConfig) CommandConfig {
+	return CommandConfig{
+		Name:           cmd.Name + " Result",
+		Icon:           "mdi:console",
+		TargetHost:     cmd.TargetHost,
+		EntityCategory: "diagnostic",
+		Device:         cmd.Device,
+	}
+}
+
+// commandState maps a command result to the state published for its entity.
+// If the run failed, or its output couldn't be parsed, it returns the error
+// text and false, and the entity's on_failure policy decides what happens.
+func commandState(cmd CommandConfig, result CommandResult) (string, bool) {
+	switch componentOf(cmd) {
+	case ComponentBinarySensor, ComponentSwitch:
+		// A non-zero exit is a valid off state
+		if result.ExitCode < 0 {
+			return result.State, false
+		}
+		return onOffState(cmd, result)
+	}
+
+	if result.Err != nil {
+		return result.State, false
+	}
+	// Extractors only see stdout, so stderr noise such as curl's progress
+	// meter doesn't break parsing; plain sensors keep the combined output
+	output := result.Output
+	if cmd.hasExtractor() {
+		output = result.Stdout
+	}
+	value, err := cmd.extract(output)
+	if err == nil {
+		// Numbers and selects only accept states they could also be set to
+		switch componentOf(cmd) {
+		case ComponentNumber, ComponentSelect:
+			value, err = parseValue(cmd, value)
+		}
+	}
+	if err != nil {
+		logger.Errorf("Failed to parse output of %s: %v", cmd.Name, err)
+		return fmt.Sprintf("ERROR: failed to parse output: %v", err), false
+	}
+	return value, true
+}
+
+// parseValue validates a value received for a number or select and returns
+// it in the form substituted into command_set
+func parseValue(cmd CommandConfig, payload string) (string, error) {
+	payload = strings.TrimSpace(payload)
+
+	if componentOf(cmd) == ComponentSelect {
+		for _, option := range cmd.Options {
+			if payload == option {
+				return option, nil
+			}
+		}
+		return "", fmt.Errorf("%q is not one of the options", payload)
+	}
+
+	value, err := strconv.ParseFloat(payload, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", fmt.Errorf("%q is not a number", payload)
+	}
+	if cmd.Min != nil && value < *cmd.Min {
+		return "", fmt.Errorf("%s is below the minimum of %v", payload, *cmd.Min)
+	}
+	if cmd.Max != nil && value > *cmd.Max {
+		return "", fmt.Errorf("%s is above the maximum of %v", payload, *cmd.Max)
+	}
+	if cmd.Step != nil {
+		// Steps count from min, as Home Assistant's slider does
+		base := 0.0
+		if cmd.Min != nil {
+			base = *cmd.Min
+		}
+		steps := (value - base) / *cmd.Step
+		if math.Abs(steps-math.Round(steps)) > 1e-9*math.Max(1, math.Abs(steps)) {
+			return "", fmt.Errorf("%s is not a multiple of the step %v", payload, *cmd.Step)
+		}
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64), nil
+}
+
+// valueCommand substitutes a validated value into command_set. The value is
+// shell quoted as well, so even an option containing spaces or quotes is
+// passed as a single argument.
+func valueCommand(cmd CommandConfig, value string) string {
+	return strings.ReplaceAll(cmd.CommandSet, valuePlaceholder, shellQuote(value))
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// onOffState derives on/off from stdout when on_match is set, and from
+// the exit code otherwise
+func onOffState(cmd CommandConfig, result CommandResult) (string, bool) {
+	on := result.ExitCode == 0
+	if cmd.OnMatch != "" {
+		re, err := compilePattern(cmd.OnMatch)
+		if err != nil {
+			logger.Errorf("Invalid on_match pattern for %s: %v", cmd.Name, err)
+			return fmt.Sprintf("ERROR: invalid on_match pattern: %v", err), false
+		}
+		on = re.MatchString(result.Stdout)
+	}
+
+	if on {
+		return payloadOn(cmd), true
+	}
+	return payloadOff(cmd), true
+}
+
+// payloadOn returns the payload a binary sensor or switch uses for on
+func payloadOn(cmd CommandConfig) string {
+	if cmd.PayloadOn == "" {
+		return defaultPayloadOn
+	}
+	return cmd.PayloadOn
+}
+
+// payloadOff returns the payload a binary sensor or switch uses for off
+func payloadOff(cmd CommandConfig) string {
+	if cmd.PayloadOff == "" {
+		return defaultPayloadOff
+	}
+	return cmd.PayloadOff
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestParseValue(t *testing.T) {
+	number := CommandConfig{Name: "fan", Component: ComponentNumber, CommandSet: "fan {value}",
+		Min: floatPtr(10), Max: floatPtr(50), Step: floatPtr(2.5)}
+	unbounded := CommandConfig{Name: "level", Component: ComponentNumber, CommandSet: "level {value}"}
+	fractional := CommandConfig{Name: "ratio", Component: ComponentNumber, CommandSet: "ratio {value}",
+		Step: floatPtr(0.1)}
+	selection := CommandConfig{Name: "mode", Component: ComponentSelect, CommandSet: "mode {value}",
+		Options: []string{"eco", "turbo boost", "it's", "$(reboot)"}}
+
+	tests := []struct {
+		name    string
+		cmd     CommandConfig
+		payload string
+		want    string
+		wantErr bool
+	}{
+		{"number in range", number, "12.5", "12.5", false},
+		{"number at min", number, "10", "10", false},
+		{"number at max", number, "50", "50", false},
+		{"number trimmed", number, " 20\n", "20", false},
+		{"number normalized", number, "2.0e1", "20", false},
+		{"number below min", number, "7.5", "", true},
+		{"number above max", number, "52.5", "", true},
+		{"number off step", number, "11", "", true},
+		{"number NaN", number, "NaN", "", true},
+		{"number Inf", unbounded, "Inf", "", true},
+		{"number negative Inf", unbounded, "-Inf", "", true},
+		{"number not numeric", number, "20; reboot", "", true},
+		{"number empty", number, "", "", true},
+		{"number hex", unbounded, "0x10", "", true},
+		{"number unbounded", unbounded, "-1234.5", "-1234.5", false},
+		{"number fractional step", fractional, "0.3", "0.3", false},
+		{"number off fractional step", fractional, "0.35", "", true},
+		{"select option", selection, "eco", "eco", false},
+		{"select option with space", selection, "turbo boost", "turbo boost", false},
+		{"select option with quote", selection, "it's", "it's", false},
+		{"select option with substitution", selection, "$(reboot)", "$(reboot)", false},
+		{"select unknown option", selection, "off", "", true},
+		{"select case sensitive", selection, "ECO", "", true},
+		{"select option prefix", selection, "eco; reboot", "", true},
+		{"select empty", selection, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseValue(tt.cmd, tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseValue(%q) error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseValue(%q) = %q, want %q", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"eco", `'eco'`},
+		{"", `''`},
+		{"turbo boost", `'turbo boost'`},
+		{"it's", `'it'\''s'`},
+		{"''", `''\'''\'''`},
+		{"$(reboot)", `'$(reboot)'`},
+		{"`reboot`", "'`reboot`'"},
+		{"$HOME", `'$HOME'`},
+		{"a; reboot", `'a; reboot'`},
+		{"line one\nline two", "'line one\nline two'"},
+		{"it's $(rm -rf /)\n", "'it'\\''s $(rm -rf /)\n'"},
+	}
+
+	sh, err := exec.LookPath("sh")
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got := shellQuote(tt.value)
+			if got != tt.want {
+				t.Errorf("shellQuote(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+
+			// The shell must see the value as one literal argument
+			if err != nil {
+				t.Skip("no sh to check the quoting with")
+			}
+			cmd := CommandConfig{CommandSet: "printf '%s' {value}"}
+			output, runErr := exec.Command(sh, "-c", valueCommand(cmd, tt.value)).Output()
+			if runErr != nil {
+				t.Fatalf("sh -c %q error = %v", valueCommand(cmd, tt.value), runErr)
+			}
+			if string(output) != tt.value {
+				t.Errorf("sh printed %q, want %q", output, tt.value)
+			}
+		})
+	}
+}
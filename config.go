@@ -13,9 +13,21 @@ import (
 type Config struct {
 	MQTT     MQTTConfig      `yaml:"mqtt"`
 	SSH      SSHConfig       `yaml:"ssh,omitempty"`
+	Defaults CommandDefaults `yaml:"defaults,omitempty"`
 	Commands []CommandConfig `yaml:"commands"`
 }
 
+// CommandDefaults holds values applied to every command that doesn't set its own
+type CommandDefaults struct {
+	Timeout   string `yaml:"timeout,omitempty"`    // duration string like "30s", "2m"
+	OnFailure string `yaml:"on_failure,omitempty"` // error, none, unavailable or fallback
+	Timezone  string `yaml:"timezone,omitempty"`   // IANA timezone for schedules and active windows (default: local time)
+
+	InitialDelay string `yaml:"initial_delay,omitempty"` // wait before the first run, e.g. "10s"
+	Jitter       string `yaml:"jitter,omitempty"`        // random delay of up to this long before every run
+	Spread       bool   `yaml:"spread,omitempty"`        // stagger the first runs of commands sharing a frequency across it
+}
+
 // MQTTConfig holds MQTT broker configuration
 type MQTTConfig struct {
 	Broker   string `yaml:"broker"`
@@ -23,22 +35,74 @@ type MQTTConfig struct {
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
 	ClientID string `yaml:"client_id"`
+
+	TLS                   bool   `yaml:"tls,omitempty"`                      // Connect with ssl:// instead of tcp://
+	CACert                string `yaml:"ca_cert,omitempty"`                  // PEM CA bundle used to verify the broker, in addition to system roots
+	ClientCert            string `yaml:"client_cert,omitempty"`              // PEM client certificate for mutual TLS
+	ClientKey             string `yaml:"client_key,omitempty"`               // PEM private key for client_cert
+	TLSServerName         string `yaml:"tls_server_name,omitempty"`          // Overrides the name checked against the broker certificate
+	TLSInsecureSkipVerify bool   `yaml:"tls_insecure_skip_verify,omitempty"` // Disables broker certificate verification
+
+	Transport        string            `yaml:"transport,omitempty"`         // "tcp" (default) or "websockets"
+	WebSocketPath    string            `yaml:"websocket_path,omitempty"`    // Path of the WebSocket endpoint (defaults to /mqtt)
+	WebSocketHeaders map[string]string `yaml:"websocket_headers,omitempty"` // Extra HTTP headers for the WebSocket handshake, e.g. proxy auth
+
+	MaxReconnectInterval string `yaml:"max_reconnect_interval,omitempty"` // Cap on the backoff between connection attempts (defaults to 2m)
+
+	OfflineBuffer OfflineBufferConfig `yaml:"offline_buffer,omitempty"`
+
+	DiscoveryPrefix string       `yaml:"discovery_prefix,omitempty"` // Home Assistant discovery prefix (defaults to "homeassistant")
+	StatusTopic     string       `yaml:"status_topic,omitempty"`     // Home Assistant birth message topic (defaults to "homeassistant/status")
+	StateTopic      string       `yaml:"state_topic,omitempty"`      // State topic template, see stateTopic for placeholders
+	Device          DeviceConfig `yaml:"device,omitempty"`
+	SingleDevice    bool         `yaml:"single_device,omitempty"` // Attach every entity to one device instead of one per target_host
+}
+
+// DeviceConfig overrides the Home Assistant device metadata
+type DeviceConfig struct {
+	Name             string `yaml:"name,omitempty"`
+	Model            string `yaml:"model,omitempty"`
+	Manufacturer     string `yaml:"manufacturer,omitempty"`
+	SwVersion        string `yaml:"sw_version,omitempty"`
+	SuggestedArea    string `yaml:"suggested_area,omitempty"`
+	ConfigurationURL string `yaml:"configuration_url,omitempty"`
+	ViaDevice        string `yaml:"via_device,omitempty"`
+}
+
+// OfflineBufferConfig controls how results are held while the broker is unreachable
+type OfflineBufferConfig struct {
+	Size       int    `yaml:"size,omitempty"`        // Results kept per sensor (defaults to 10, negative disables buffering)
+	DropPolicy string `yaml:"drop_policy,omitempty"` // "oldest" (default) or "newest" result is dropped when full
+	File       string `yaml:"file,omitempty"`        // Optional file the buffer is persisted to across restarts
 }
 
 // SSHConfig holds SSH configuration
 type SSHConfig struct {
-	Hosts []SSHHost `yaml:"hosts,omitempty"`
+	Hosts       []SSHHost `yaml:"hosts,omitempty"`
+	ConfigFile  string    `yaml:"config_file,omitempty"`  // OpenSSH client config to import hosts from, e.g. "~/.ssh/config"
+	ImportHosts []string  `yaml:"import_hosts,omitempty"` // Host aliases to import (defaults to the aliases used as target_host)
+	StateDir    string    `yaml:"state_dir,omitempty"`    // Where files we write, such as tofu's known_hosts, are kept (defaults to ~/.local/state/ha-command-to-mqtt)
 }
 
 // SSHHost represents an SSH host configuration
 type SSHHost struct {
-	Name       string `yaml:"name"`
-	Host       string `yaml:"host"`
-	Port       int    `yaml:"port"`
-	User       string `yaml:"user"`
-	KeyPath    string `yaml:"key_path,omitempty"`
-	Password   string `yaml:"password,omitempty"`
-	Timeout    string `yaml:"timeout,omitempty"`
+	Name     string `yaml:"name"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	KeyPath  string `yaml:"key_path,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Timeout  string `yaml:"timeout,omitempty"`
+
+	KeyPassphrase     string `yaml:"key_passphrase,omitempty"`      // Passphrase for an encrypted key_path
+	KeyPassphraseFile string `yaml:"key_passphrase_file,omitempty"` // File containing the passphrase, takes precedence over key_passphrase
+	CertificatePath   string `yaml:"certificate_path,omitempty"`    // OpenSSH user certificate for key_path (e.g. id_ed25519-cert.pub)
+
+	JumpHost string `yaml:"jump_host,omitempty"` // Name of another configured host to tunnel through
+
+	KnownHosts          string `yaml:"known_hosts,omitempty"`           // Path to known_hosts file (defaults to ~/.ssh/known_hosts, or known_hosts in ssh.state_dir in tofu mode)
+	HostKeyFingerprint  string `yaml:"host_key_fingerprint,omitempty"`  // Pinned SHA256 host key fingerprint, overrides known_hosts
+	HostKeyVerification string `yaml:"host_key_verification,omitempty"` // "known_hosts" (default), "tofu" or "insecure"
 }
 
 // CommandConfig represents a command to be executed
@@ -54,29 +118,100 @@ type CommandConfig struct {
 	StateClass     string `yaml:"state_class,omitempty"`
 	EntityCategory string `yaml:"entity_category,omitempty"`
 	ExpireAfter    int    `yaml:"expire_after,omitempty"`
+	Timeout        string `yaml:"timeout,omitempty"` // maximum run time before the command is killed
+
+	Schedule    string `yaml:"schedule,omitempty"`     // cron expression, optionally with seconds; replaces frequency
+	Timezone    string `yaml:"timezone,omitempty"`     // IANA timezone the schedule and active window are evaluated in
+	ActiveHours string `yaml:"active_hours,omitempty"` // only run between these times, e.g. "08:00-22:00"
+	ActiveDays  string `yaml:"active_days,omitempty"`  // only run on these days, e.g. "mon-fri", "weekends"
+
+	InitialDelay string `yaml:"initial_delay,omitempty"` // wait before the first run (frequency only)
+	Jitter       string `yaml:"jitter,omitempty"`        // random delay of up to this long before every run
+
+	Component  string `yaml:"component,omitempty"`   // sensor (default), binary_sensor, switch, button, number or select
+	PayloadOn  string `yaml:"payload_on,omitempty"`  // binary_sensor/switch state when on (default "ON")
+	PayloadOff string `yaml:"payload_off,omitempty"` // binary_sensor/switch state when off (default "OFF")
+	OnMatch    string `yaml:"on_match,omitempty"`    // binary_sensor/switch is on when the output matches this regex (default: exit code 0)
+
+	CommandOn    string `yaml:"command_on,omitempty"`    // switch: run when turned on
+	CommandOff   string `yaml:"command_off,omitempty"`   // switch: run when turned off
+	CommandState string `yaml:"command_state,omitempty"` // switch: run every frequency to read the state (optional)
+	ResultSensor bool   `yaml:"result_sensor,omitempty"` // button: add a sensor showing the output of the last run
+
+	CommandSet string   `yaml:"command_set,omitempty"` // number/select: run with {value} replaced by the chosen value
+	Min        *float64 `yaml:"min,omitempty"`         // number: minimum value
+	Max        *float64 `yaml:"max,omitempty"`         // number: maximum value
+	Step       *float64 `yaml:"step,omitempty"`        // number: step size
+	Options    []string `yaml:"options,omitempty"`     // select: the values to choose from
+
+	ValueExtractor `yaml:",inline"` // value_json, value_regex or value_template applied to the output
+
+	Sensors []SensorConfig `yaml:"sensors,omitempty"` // several sensors extracted from one run of the command
+
+	Attributes     []string          `yaml:"attributes,omitempty"`      // run details published as attributes: exit_code, duration, host, timestamp, stderr, error
+	JSONAttributes map[string]string `yaml:"json_attributes,omitempty"` // attribute name -> value_json path into the output
+
+	OnFailure     string `yaml:"on_failure,omitempty"`     // error (sensor default), none (default otherwise), unavailable or fallback
+	FallbackValue string `yaml:"fallback_value,omitempty"` // state published on failure with on_failure: fallback
+
+	Device DeviceConfig `yaml:"device,omitempty"` // Home Assistant device to group the entity under (defaults to one device per target_host)
+}
+
+// SensorConfig is one of several sensors derived from a single command's
+// output. Unset fields are inherited from the command.
+type SensorConfig struct {
+	Name           string `yaml:"name"`
+	DeviceClass    string `yaml:"device_class,omitempty"`
+	Unit           string `yaml:"unit,omitempty"`
+	Icon           string `yaml:"icon,omitempty"`
+	StateClass     string `yaml:"state_class,omitempty"`
+	EntityCategory string `yaml:"entity_category,omitempty"`
+
+	ValueExtractor `yaml:",inline"` // value_json, value_regex or value_template applied to the shared output
 }
 
 // HomeAssistantDiscovery represents the HA discovery payload
 type HomeAssistantDiscovery struct {
-	Name              string `json:"name"`
-	StateTopic        string `json:"state_topic"`
-	UniqueID          string `json:"unique_id"`
-	DeviceClass       string `json:"device_class,omitempty"`
-	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
-	Icon              string `json:"icon,omitempty"`
-	Device            Device `json:"device"`
-	ForceUpdate       bool   `json:"force_update,omitempty"`
-	StateClass        string `json:"state_class,omitempty"`
-	EntityCategory    string `json:"entity_category,omitempty"`
-	ExpireAfter       int    `json:"expire_after,omitempty"`
+	Name              string   `json:"name"`
+	StateTopic        string   `json:"state_topic,omitempty"`
+	AvailabilityTopic string   `json:"availability_topic,omitempty"`
+	UniqueID          string   `json:"unique_id"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	Device            Device   `json:"device"`
+	ForceUpdate       bool     `json:"force_update,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	EntityCategory    string   `json:"entity_category,omitempty"`
+	ExpireAfter       int      `json:"expire_after,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	CommandTopic      string   `json:"command_topic,omitempty"`
+	Min               *float64 `json:"min,omitempty"`
+	Max               *float64 `json:"max,omitempty"`
+	Step              *float64 `json:"step,omitempty"`
+	Options           []string `json:"options,omitempty"`
+
+	JSONAttributesTopic string         `json:"json_attributes_topic,omitempty"`
+	Availability        []Availability `json:"availability,omitempty"`
+	AvailabilityMode    string         `json:"availability_mode,omitempty"`
+}
+
+// Availability is one of several availability topics of an entity
+type Availability struct {
+	Topic string `json:"topic"`
 }
 
 // Device represents the device information for HA
 type Device struct {
-	Identifiers  []string `json:"identifiers"`
-	Name         string   `json:"name"`
-	Model        string   `json:"model"`
-	Manufacturer string   `json:"manufacturer"`
+	Identifiers      []string `json:"identifiers"`
+	Name             string   `json:"name"`
+	Model            string   `json:"model"`
+	Manufacturer     string   `json:"manufacturer"`
+	SwVersion        string   `json:"sw_version,omitempty"`
+	SuggestedArea    string   `json:"suggested_area,omitempty"`
+	ConfigurationURL string   `json:"configuration_url,omitempty"`
+	ViaDevice        string   `json:"via_device,omitempty"`
 }
 
 // LoadConfig loads configuration from file or environment variables
@@ -116,17 +251,112 @@ func loadConfigFromYAML(filename string, config *Config) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file %s: %v", filename, err)
 	}
 
+	if err := importSSHConfigHosts(&config.SSH, config.Commands); err != nil {
+		return nil, err
+	}
+
+	applyCommandDefaults(config)
+
+	if err := validateCommands(config); err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
 
+// applyCommandDefaults fills unset command fields from the defaults block
+func applyCommandDefaults(config *Config) {
+	for i := range config.Commands {
+		if config.Commands[i].Timeout == "" {
+			config.Commands[i].Timeout = config.Defaults.Timeout
+		}
+		if config.Commands[i].OnFailure == "" {
+			config.Commands[i].OnFailure = config.Defaults.OnFailure
+		}
+		if config.Commands[i].Timezone == "" {
+			config.Commands[i].Timezone = config.Defaults.Timezone
+		}
+		// Scheduled commands run at fixed times, so a default delay doesn't apply
+		if config.Commands[i].InitialDelay == "" && config.Commands[i].Schedule == "" {
+			config.Commands[i].InitialDelay = config.Defaults.InitialDelay
+		}
+		if config.Commands[i].Jitter == "" {
+			config.Commands[i].Jitter = config.Defaults.Jitter
+		}
+	}
+}
+
+// validateCommands rejects commands with settings that can never work
+func validateCommands(config *Config) error {
+	for _, cmd := range config.Commands {
+		if err := validateComponent(cmd); err != nil {
+			return err
+		}
+		if err := validateSchedule(cmd); err != nil {
+			return err
+		}
+		if err := validateDevice(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func loadConfigFromEnv(config *Config) (*Config, error) {
 	// MQTT configuration from environment
+	useTLS := getEnvBoolOrDefault("MQTT_TLS", false)
+	defaultPort := defaultBrokerPort(os.Getenv("MQTT_TRANSPORT"), useTLS)
+
 	config.MQTT = MQTTConfig{
 		Broker:   getEnvOrDefault("MQTT_BROKER", "localhost"),
-		Port:     getEnvIntOrDefault("MQTT_PORT", 1883),
+		Port:     getEnvIntOrDefault("MQTT_PORT", defaultPort),
 		Username: os.Getenv("MQTT_USERNAME"),
 		Password: os.Getenv("MQTT_PASSWORD"),
 		ClientID: getEnvOrDefault("MQTT_CLIENT_ID", "ha-command-to-mqtt"),
+
+		TLS:                   useTLS,
+		CACert:                os.Getenv("MQTT_CA_CERT"),
+		ClientCert:            os.Getenv("MQTT_CLIENT_CERT"),
+		ClientKey:             os.Getenv("MQTT_CLIENT_KEY"),
+		TLSServerName:         os.Getenv("MQTT_TLS_SERVER_NAME"),
+		TLSInsecureSkipVerify: getEnvBoolOrDefault("MQTT_TLS_INSECURE_SKIP_VERIFY", false),
+
+		Transport:        os.Getenv("MQTT_TRANSPORT"),
+		WebSocketPath:    os.Getenv("MQTT_WEBSOCKET_PATH"),
+		WebSocketHeaders: getEnvMapOrDefault("MQTT_WEBSOCKET_HEADERS", nil),
+
+		MaxReconnectInterval: os.Getenv("MQTT_MAX_RECONNECT_INTERVAL"),
+
+		OfflineBuffer: OfflineBufferConfig{
+			Size:       getEnvIntOrDefault("MQTT_OFFLINE_BUFFER_SIZE", 0),
+			DropPolicy: os.Getenv("MQTT_OFFLINE_BUFFER_DROP_POLICY"),
+			File:       os.Getenv("MQTT_OFFLINE_BUFFER_FILE"),
+		},
+
+		DiscoveryPrefix: os.Getenv("MQTT_DISCOVERY_PREFIX"),
+		StatusTopic:     os.Getenv("MQTT_STATUS_TOPIC"),
+		StateTopic:      os.Getenv("MQTT_STATE_TOPIC"),
+		Device: DeviceConfig{
+			Name:             os.Getenv("MQTT_DEVICE_NAME"),
+			Model:            os.Getenv("MQTT_DEVICE_MODEL"),
+			Manufacturer:     os.Getenv("MQTT_DEVICE_MANUFACTURER"),
+			SwVersion:        os.Getenv("MQTT_DEVICE_SW_VERSION"),
+			SuggestedArea:    os.Getenv("MQTT_DEVICE_SUGGESTED_AREA"),
+			ConfigurationURL: os.Getenv("MQTT_DEVICE_CONFIGURATION_URL"),
+			ViaDevice:        os.Getenv("MQTT_DEVICE_VIA_DEVICE"),
+		},
+		SingleDevice: getEnvBoolOrDefault("MQTT_SINGLE_DEVICE", false),
+	}
+
+	// Command defaults from environment
+	config.Defaults = CommandDefaults{
+		Timeout:   os.Getenv("DEFAULT_COMMAND_TIMEOUT"),
+		OnFailure: os.Getenv("DEFAULT_ON_FAILURE"),
+		Timezone:  os.Getenv("DEFAULT_TIMEZONE"),
+
+		InitialDelay: os.Getenv("DEFAULT_INITIAL_DELAY"),
+		Jitter:       os.Getenv("DEFAULT_JITTER"),
+		Spread:       getEnvBoolOrDefault("DEFAULT_SPREAD", false),
 	}
 
 	// Commands from environment variables
@@ -135,6 +365,34 @@ func loadConfigFromEnv(config *Config) (*Config, error) {
 	// Optional: COMMAND_<NAME>_DEVICE_CLASS=<class>
 	// Optional: COMMAND_<NAME>_UNIT=<unit>
 	// Optional: COMMAND_<NAME>_ICON=<icon>
+	// Optional: COMMAND_<NAME>_TIMEOUT=<duration>
+	// Optional: COMMAND_<NAME>_DEVICE=<device name>
+	// Optional: COMMAND_<NAME>_COMPONENT=<sensor|binary_sensor>
+	// Optional: COMMAND_<NAME>_PAYLOAD_ON=<payload>
+	// Optional: COMMAND_<NAME>_PAYLOAD_OFF=<payload>
+	// Optional: COMMAND_<NAME>_ON_MATCH=<regex>
+	// Optional: COMMAND_<NAME>_COMMAND_ON=<command>
+	// Optional: COMMAND_<NAME>_COMMAND_OFF=<command>
+	// Optional: COMMAND_<NAME>_COMMAND_STATE=<command>
+	// Optional: COMMAND_<NAME>_RESULT_SENSOR=<true|false>
+	// Optional: COMMAND_<NAME>_COMMAND_SET=<command with {value}>
+	// Optional: COMMAND_<NAME>_MIN=<number>
+	// Optional: COMMAND_<NAME>_MAX=<number>
+	// Optional: COMMAND_<NAME>_STEP=<number>
+	// Optional: COMMAND_<NAME>_OPTIONS=<option1,option2,...>
+	// Optional: COMMAND_<NAME>_VALUE_JSON=<path>
+	// Optional: COMMAND_<NAME>_VALUE_REGEX=<regex>
+	// Optional: COMMAND_<NAME>_VALUE_TEMPLATE=<template>
+	// Optional: COMMAND_<NAME>_ATTRIBUTES=<attribute1,attribute2,...>
+	// Optional: COMMAND_<NAME>_JSON_ATTRIBUTES=<name=path,...>
+	// Optional: COMMAND_<NAME>_ON_FAILURE=<error|none|unavailable|fallback>
+	// Optional: COMMAND_<NAME>_FALLBACK_VALUE=<value>
+	// Optional: COMMAND_<NAME>_SCHEDULE=<cron expression>
+	// Optional: COMMAND_<NAME>_TIMEZONE=<timezone>
+	// Optional: COMMAND_<NAME>_ACTIVE_HOURS=<HH:MM-HH:MM>
+	// Optional: COMMAND_<NAME>_ACTIVE_DAYS=<days>
+	// Optional: COMMAND_<NAME>_INITIAL_DELAY=<duration>
+	// Optional: COMMAND_<NAME>_JITTER=<duration>
 
 	commands := make(map[string]CommandConfig)
 
@@ -162,6 +420,12 @@ func loadConfigFromEnv(config *Config) (*Config, error) {
 				cmd.Name = name
 				cmd.DeviceClass = value
 				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_DEVICE") {
+				name := strings.TrimSuffix(parsedKey, "_DEVICE")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.Device.Name = value
+				commands[name] = cmd
 			} else if strings.Contains(parsedKey, "_UNIT") {
 				name := strings.TrimSuffix(parsedKey, "_UNIT")
 				cmd := commands[name]
@@ -206,6 +470,174 @@ func loadConfigFromEnv(config *Config) (*Config, error) {
 					cmd.ExpireAfter = intValue
 				}
 				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_COMPONENT") {
+				name := strings.TrimSuffix(parsedKey, "_COMPONENT")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.Component = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_PAYLOAD_ON") {
+				name := strings.TrimSuffix(parsedKey, "_PAYLOAD_ON")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.PayloadOn = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_PAYLOAD_OFF") {
+				name := strings.TrimSuffix(parsedKey, "_PAYLOAD_OFF")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.PayloadOff = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_ON_MATCH") {
+				name := strings.TrimSuffix(parsedKey, "_ON_MATCH")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.OnMatch = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_COMMAND_ON") {
+				name := strings.TrimSuffix(parsedKey, "_COMMAND_ON")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.CommandOn = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_COMMAND_OFF") {
+				name := strings.TrimSuffix(parsedKey, "_COMMAND_OFF")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.CommandOff = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_INITIAL_DELAY") {
+				name := strings.TrimSuffix(parsedKey, "_INITIAL_DELAY")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.InitialDelay = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_JITTER") {
+				name := strings.TrimSuffix(parsedKey, "_JITTER")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.Jitter = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_SCHEDULE") {
+				name := strings.TrimSuffix(parsedKey, "_SCHEDULE")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.Schedule = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_TIMEZONE") {
+				name := strings.TrimSuffix(parsedKey, "_TIMEZONE")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.Timezone = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_ACTIVE_HOURS") {
+				name := strings.TrimSuffix(parsedKey, "_ACTIVE_HOURS")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.ActiveHours = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_ACTIVE_DAYS") {
+				name := strings.TrimSuffix(parsedKey, "_ACTIVE_DAYS")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.ActiveDays = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_ON_FAILURE") {
+				name := strings.TrimSuffix(parsedKey, "_ON_FAILURE")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.OnFailure = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_FALLBACK_VALUE") {
+				name := strings.TrimSuffix(parsedKey, "_FALLBACK_VALUE")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.FallbackValue = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_JSON_ATTRIBUTES") {
+				name := strings.TrimSuffix(parsedKey, "_JSON_ATTRIBUTES")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.JSONAttributes = parseMap(value)
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_ATTRIBUTES") {
+				name := strings.TrimSuffix(parsedKey, "_ATTRIBUTES")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.Attributes = parseList(value)
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_VALUE_JSON") {
+				name := strings.TrimSuffix(parsedKey, "_VALUE_JSON")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.ValueJSON = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_VALUE_REGEX") {
+				name := strings.TrimSuffix(parsedKey, "_VALUE_REGEX")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.ValueRegex = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_VALUE_TEMPLATE") {
+				name := strings.TrimSuffix(parsedKey, "_VALUE_TEMPLATE")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.ValueTemplate = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_COMMAND_SET") {
+				name := strings.TrimSuffix(parsedKey, "_COMMAND_SET")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.CommandSet = value
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_MIN") {
+				name := strings.TrimSuffix(parsedKey, "_MIN")
+				cmd := commands[name]
+				cmd.Name = name
+				if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+					cmd.Min = &floatValue
+				}
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_MAX") {
+				name := strings.TrimSuffix(parsedKey, "_MAX")
+				cmd := commands[name]
+				cmd.Name = name
+				if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+					cmd.Max = &floatValue
+				}
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_STEP") {
+				name := strings.TrimSuffix(parsedKey, "_STEP")
+				cmd := commands[name]
+				cmd.Name = name
+				if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+					cmd.Step = &floatValue
+				}
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_OPTIONS") {
+				name := strings.TrimSuffix(parsedKey, "_OPTIONS")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.Options = parseList(value)
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_RESULT_SENSOR") {
+				name := strings.TrimSuffix(parsedKey, "_RESULT_SENSOR")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.ResultSensor = strings.ToLower(value) == "true"
+				commands[name] = cmd
+			} else if strings.HasSuffix(parsedKey, "_COMMAND_STATE") {
+				name := strings.TrimSuffix(parsedKey, "_COMMAND_STATE")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.CommandState = value
+				commands[name] = cmd
+			} else if strings.Contains(parsedKey, "_TIMEOUT") {
+				name := strings.TrimSuffix(parsedKey, "_TIMEOUT")
+				cmd := commands[name]
+				cmd.Name = name
+				cmd.Timeout = value
+				commands[name] = cmd
 			} else {
 				// This is the command itself
 				cmd := commands[parsedKey]
@@ -221,7 +653,10 @@ func loadConfigFromEnv(config *Config) (*Config, error) {
 
 	// Convert map to slice
 	for _, cmd := range commands {
-		if cmd.Command != "" { // Only add commands that have an actual command
+		if cmd.Command != "" || cmd.CommandOn != "" || cmd.CommandOff != "" || cmd.CommandSet != "" { // Only add commands that have an actual command
+			if cmd.Frequency == "" {
+				cmd.Frequency = "60s" // Default frequency
+			}
 			config.Commands = append(config.Commands, cmd)
 		}
 	}
@@ -230,6 +665,12 @@ func loadConfigFromEnv(config *Config) (*Config, error) {
 		return nil, fmt.Errorf("no commands configured")
 	}
 
+	applyCommandDefaults(config)
+
+	if err := validateCommands(config); err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
 
@@ -247,4 +688,46 @@ func getEnvIntOrDefault(key string, defaultValue int) int {
 		}
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+
+func getEnvBoolOrDefault(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvMapOrDefault parses a comma-separated list of Name=Value pairs
+func getEnvMapOrDefault(key string, defaultValue map[string]string) map[string]string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return parseMap(value)
+}
+
+// parseMap parses a comma-separated list of Name=Value pairs
+func parseMap(value string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return result
+}
+
+// parseList parses a comma-separated list, dropping empty entries
+func parseList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
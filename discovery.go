@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Defaults for the configurable topic layout and device metadata
+const (
+	defaultDiscoveryPrefix    = "homeassistant"
+	defaultStatusTopic        = "homeassistant/status"
+	defaultStateTopicTemplate = "{prefix}/{component}/{sensor_id}/state"
+	defaultDeviceName         = "Command Sensors"
+	defaultDeviceModel        = "HA Command to MQTT"
+	defaultDeviceManufacturer = "Custom"
+)
+
+// topicSettings holds the topic layout and device metadata, set by InitMQTT
+var topicSettings = struct {
+	prefix             string
+	statusTopic        string
+	stateTopicTemplate string
+	device             DeviceConfig
+	singleDevice       bool
+	instanceDevice     bool // some entity is attached to the instance's own device
+}{
+	prefix:             defaultDiscoveryPrefix,
+	statusTopic:        defaultStatusTopic,
+	stateTopicTemplate: defaultStateTopicTemplate,
+}
+
+// announcedSensor is a command whose discovery message has been sent, along
+// with the last state published for it
+type announcedSensor struct {
+	cmd            CommandConfig
+	clientID       string
+	lastState      string
+	hasState       bool
+	lastAttributes string
+	availability   string
+}
+
+// announced tracks every sensor we've sent discovery for so it can be replayed
+// when Home Assistant restarts or the broker connection is re-established
+var (
+	announcedMu    sync.Mutex
+	announced      = make(map[string]*announcedSensor)
+	announcedOrder []string
+	connectedOnce  bool
+)
+
+// configureTopics applies the discovery prefix, status topic, state topic
+// template and device metadata from the MQTT configuration
+func configureTopics(config *MQTTConfig) {
+	topicSettings.prefix = strings.TrimSuffix(config.DiscoveryPrefix, "/")
+	if topicSettings.prefix == "" {
+		topicSettings.prefix = defaultDiscoveryPrefix
+	}
+
+	// Home Assistant configures its birth topic separately from the discovery prefix
+	topicSettings.statusTopic = config.StatusTopic
+	if topicSettings.statusTopic == "" {
+		topicSettings.statusTopic = defaultStatusTopic
+	}
+
+	topicSettings.stateTopicTemplate = config.StateTopic
+	if topicSettings.stateTopicTemplate == "" {
+		topicSettings.stateTopicTemplate = defaultStateTopicTemplate
+	}
+	if !strings.Contains(topicSettings.stateTopicTemplate, "{sensor_id}") && !strings.Contains(topicSettings.stateTopicTemplate, "{name}") {
+		logger.Warnf("State topic template %q has no {sensor_id} or {name}, every sensor will share one topic", topicSettings.stateTopicTemplate)
+	}
+
+	topicSettings.device = config.Device
+	topicSettings.singleDevice = config.SingleDevice
+}
+
+// homeAssistantStatusTopic is where Home Assistant publishes its birth and will messages
+func homeAssistantStatusTopic() string {
+	return topicSettings.statusTopic
+}
+
+// availabilityTopic returns the device-level topic Home Assistant watches to
+// decide whether our entities are available
+func availabilityTopic(clientID string) string {
+	return fmt.Sprintf("%s/sensor/%s/availability", topicSettings.prefix, clientID)
+}
+
+// sensorID returns the unique ID of a command's sensor
+func sensorID(cmd CommandConfig, clientID string) string {
+	return fmt.Sprintf("%s_%s", clientID, sanitizeName(cmd.Name))
+}
+
+// discoveryTopic returns the topic a sensor's discovery config is published to
+func discoveryTopic(cmd CommandConfig, clientID string) string {
+	return fmt.Sprintf("%s/%s/%s/config", topicSettings.prefix, componentOf(cmd), sensorID(cmd, clientID))
+}
+
+// attributesTopic returns the topic a sensor's JSON attributes are published to
+func attributesTopic(cmd CommandConfig, clientID string) string {
+	return fmt.Sprintf("%s/%s/%s/attributes", topicSettings.prefix, componentOf(cmd), sensorID(cmd, clientID))
+}
+
+// stateTopic expands the state topic template for a sensor
+func stateTopic(cmd CommandConfig, clientID string) string {
+	replacer := strings.NewReplacer(
+		"{prefix}", topicSettings.prefix,
+		"{component}", componentOf(cmd),
+		"{client_id}", clientID,
+		"{sensor_id}", sensorID(cmd, clientID),
+		"{name}", sanitizeName(cmd.Name),
+	)
+	return replacer.Replace(topicSettings.stateTopicTemplate)
+}
+
+// validateDevice checks that a command's device block names its device,
+// since devices are told apart by name
+func validateDevice(cmd CommandConfig) error {
+	if cmd.Device != (DeviceConfig{}) && cmd.Device.Name == "" {
+		return fmt.Errorf("command %s: device needs a name", cmd.Name)
+	}
+	return nil
+}
+
+// configureInstanceDevice records whether any command's entities are
+// attached to the instance's own device. Other devices only link to it
+// through via_device when it exists, since Home Assistant can't resolve a
+// reference to a device nothing announced.
+func configureInstanceDevice(commands []CommandConfig) {
+	topicSettings.instanceDevice = false
+	for _, cmd := range commands {
+		if onInstanceDevice(cmd) {
+			topicSettings.instanceDevice = true
+			return
+		}
+	}
+}
+
+// onInstanceDevice reports whether a command's entities belong to the
+// instance's own device rather than a named or per-host device
+func onInstanceDevice(cmd CommandConfig) bool {
+	return topicSettings.singleDevice ||
+		(cmd.Device.Name == "" && (cmd.TargetHost == "" || cmd.TargetHost == "local"))
+}
+
+// deviceInfo returns the Home Assistant device a command's entity is attached
+// to. Commands with an explicit device are grouped by its name, remote
+// commands get one device per SSH host, and local commands share the
+// instance's own device.
+func deviceInfo(cmd CommandConfig, clientID string) Device {
+	config := topicSettings.device
+	identifier := clientID
+
+	// Devices hang off the instance's device only if it is announced
+	instanceVia := ""
+	if topicSettings.instanceDevice {
+		instanceVia = clientID
+	}
+
+	switch {
+	case onInstanceDevice(cmd):
+	case cmd.Device.Name != "":
+		config = mergeDeviceConfig(cmd.Device, config)
+		if config.ViaDevice == "" {
+			config.ViaDevice = instanceVia
+		}
+		identifier = fmt.Sprintf("%s_%s", clientID, sanitizeName(cmd.Device.Name))
+	default:
+		config = mergeDeviceConfig(DeviceConfig{Name: cmd.TargetHost}, config)
+		config.ViaDevice = instanceVia
+		identifier = fmt.Sprintf("%s_%s", clientID, sanitizeName(cmd.TargetHost))
+	}
+
+	device := Device{
+		Identifiers:      []string{identifier},
+		Name:             config.Name,
+		Model:            config.Model,
+		Manufacturer:     config.Manufacturer,
+		SwVersion:        config.SwVersion,
+		SuggestedArea:    config.SuggestedArea,
+		ConfigurationURL: config.ConfigurationURL,
+		ViaDevice:        config.ViaDevice,
+	}
+
+	if device.Name == "" {
+		device.Name = defaultDeviceName
+	}
+	if device.Model == "" {
+		device.Model = defaultDeviceModel
+	}
+	if device.Manufacturer == "" {
+		device.Manufacturer = defaultDeviceManufacturer
+	}
+	if device.SwVersion == "" {
+		device.SwVersion = version
+	}
+
+	return device
+}
+
+// mergeDeviceConfig fills the fields override leaves empty from base. The
+// instance-wide suggested area and configuration URL describe the instance's
+// own device, so they aren't inherited.
+func mergeDeviceConfig(override, base DeviceConfig) DeviceConfig {
+	merged := override
+	if merged.Model == "" {
+		merged.Model = base.Model
+	}
+	if merged.Manufacturer == "" {
+		merged.Manufacturer = base.Manufacturer
+	}
+	if merged.SwVersion == "" {
+		merged.SwVersion = base.SwVersion
+	}
+	return merged
+}
+
+// replayDiscovery re-sends the discovery message and last known state of every announced sensor
+func replayDiscovery() {
+	announcedMu.Lock()
+	sensors := make([]announcedSensor, 0, len(announcedOrder))
+	for _, sensorID := range announcedOrder {
+		sensors = append(sensors, *announced[sensorID])
+	}
+	announcedMu.Unlock()
+
+	for _, sensor := range sensors {
+		publishDiscovery(sensor.cmd, sensor.clientID)
+		if sensor.hasState {
+			publishState(sensor.cmd, sensor.lastState, sensor.clientID)
+		}
+		if sensor.lastAttributes != "" {
+			publishAttributes(sensor.cmd, sensor.lastAttributes, sensor.clientID)
+		}
+		if sensor.availability != "" {
+			publishEntityAvailability(sensor.cmd, sensor.clientID, sensor.availability)
+		}
+	}
+}
+
+// SendDiscoveryMessage sends Home Assistant discovery message and remembers
+// the sensor so discovery can be replayed later
+func SendDiscoveryMessage(cmd CommandConfig, clientID string) {
+	id := sensorID(cmd, clientID)
+
+	announcedMu.Lock()
+	if _, exists := announced[id]; !exists {
+		announcedOrder = append(announcedOrder, id)
+	}
+	announced[id] = &announcedSensor{cmd: cmd, clientID: clientID}
+	announcedMu.Unlock()
+
+	publishDiscovery(cmd, clientID)
+}
+
+// publishDiscovery publishes the discovery message for a sensor
+func publishDiscovery(cmd CommandConfig, clientID string) {
+	discovery := HomeAssistantDiscovery{
+		Name:              cmd.Name,
+		StateTopic:        stateTopic(cmd, clientID),
+		AvailabilityTopic: availabilityTopic(clientID),
+		UniqueID:          sensorID(cmd, clientID),
+		Device:            deviceInfo(cmd, clientID),
+	}
+
+	if cmd.DeviceClass != "" {
+		discovery.DeviceClass = cmd.DeviceClass
+	}
+	if cmd.Unit != "" && (componentOf(cmd) == ComponentSensor || componentOf(cmd) == ComponentNumber) {
+		discovery.UnitOfMeasurement = cmd.Unit
+	}
+	if cmd.Icon != "" {
+		discovery.Icon = cmd.Icon
+	}
+	if cmd.ForceUpdate {
+		discovery.ForceUpdate = cmd.ForceUpdate
+	}
+	if cmd.StateClass != "" && componentOf(cmd) == ComponentSensor {
+		discovery.StateClass = cmd.StateClass
+	}
+	if cmd.EntityCategory != "" {
+		discovery.EntityCategory = cmd.EntityCategory
+	}
+	if cmd.ExpireAfter > 0 {
+		discovery.ExpireAfter = cmd.ExpireAfter
+	}
+	if hasAttributes(cmd) {
+		discovery.JSONAttributesTopic = attributesTopic(cmd, clientID)
+	}
+	if failurePolicy(cmd) == OnFailureUnavailable {
+		// The entity is available only while both the instance and its last run are
+		discovery.AvailabilityTopic = ""
+		discovery.Availability = []Availability{
+			{Topic: availabilityTopic(clientID)},
+			{Topic: entityAvailabilityTopic(cmd, clientID)},
+		}
+		discovery.AvailabilityMode = "all"
+	}
+	switch componentOf(cmd) {
+	case ComponentBinarySensor:
+		discovery.PayloadOn = payloadOn(cmd)
+		discovery.PayloadOff = payloadOff(cmd)
+	case ComponentSwitch:
+		discovery.PayloadOn = payloadOn(cmd)
+		discovery.PayloadOff = payloadOff(cmd)
+		discovery.CommandTopic = commandTopic(cmd, clientID)
+	case ComponentNumber:
+		discovery.CommandTopic = commandTopic(cmd, clientID)
+		discovery.Min = cmd.Min
+		discovery.Max = cmd.Max
+		discovery.Step = cmd.Step
+	case ComponentSelect:
+		discovery.CommandTopic = commandTopic(cmd, clientID)
+		discovery.Options = cmd.Options
+	case ComponentButton:
+		// Buttons are stateless
+		discovery.StateTopic = ""
+		discovery.ForceUpdate = false
+		discovery.ExpireAfter = 0
+		discovery.CommandTopic = commandTopic(cmd, clientID)
+	}
+
+	payload, err := json.Marshal(discovery)
+	if err != nil {
+		logger.Errorf("Failed to marshal discovery message for %s: %v", cmd.Name, err)
+		return
+	}
+
+	token := mqttClient.Publish(discoveryTopic(cmd, clientID), 0, true, payload)
+	token.Wait()
+
+	logger.Infof("Sent discovery message for %s", cmd.Name)
+}
+
+// PublishResult publishes command result to MQTT
+func PublishResult(cmd CommandConfig, result string, clientID string) {
+	announcedMu.Lock()
+	if sensor, exists := announced[sensorID(cmd, clientID)]; exists {
+		sensor.lastState = result
+		sensor.hasState = true
+	}
+	announcedMu.Unlock()
+
+	publishState(cmd, result, clientID)
+}
+
+// publishState publishes a state to a sensor's state topic
+func publishState(cmd CommandConfig, result string, clientID string) {
+	if !offlineBuffer.Publish(sensorID(cmd, clientID), stateTopic(cmd, clientID), result) {
+		logger.Infof("Buffered result for %s until the MQTT broker is available: %s", cmd.Name, result)
+		return
+	}
+
+	logger.Infof("Published result for %s: %s", cmd.Name, result)
+}
+
+// PublishAttributes publishes the attributes of a command run to a sensor's attributes topic
+func PublishAttributes(cmd CommandConfig, result CommandResult, clientID string) {
+	attributes, err := commandAttributes(cmd, result)
+	if err != nil {
+		logger.Errorf("Failed to build attributes for %s: %v", cmd.Name, err)
+		return
+	}
+
+	announcedMu.Lock()
+	if sensor, exists := announced[sensorID(cmd, clientID)]; exists {
+		sensor.lastAttributes = attributes
+	}
+	announcedMu.Unlock()
+
+	publishAttributes(cmd, attributes, clientID)
+}
+
+// publishAttributes publishes attributes to a sensor's attributes topic
+func publishAttributes(cmd CommandConfig, attributes string, clientID string) {
+	if !offlineBuffer.Publish(sensorID(cmd, clientID)+"/attributes", attributesTopic(cmd, clientID), attributes) {
+		logger.Debugf("Buffered attributes for %s until the MQTT broker is available", cmd.Name)
+		return
+	}
+
+	logger.Debugf("Published attributes for %s: %s", cmd.Name, attributes)
+}
+
+// sanitizeName replaces spaces and special characters with underscores
+func sanitizeName(name string) string {
+	// Replace spaces and special characters with underscores
+	result := strings.ToLower(name)
+	result = strings.ReplaceAll(result, " ", "_")
+	result = strings.ReplaceAll(result, "-", "_")
+	// Remove any characters that aren't alphanumeric or underscore
+	var sanitized strings.Builder
+	for _, r := range result {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			sanitized.WriteRune(r)
+		}
+	}
+	return sanitized.String()
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestDeviceInfoViaDevice(t *testing.T) {
+	previous := topicSettings
+	t.Cleanup(func() { topicSettings = previous })
+
+	local := CommandConfig{Name: "uptime"}
+	remote := CommandConfig{Name: "load", TargetHost: "nas"}
+	named := CommandConfig{Name: "ups", Device: DeviceConfig{Name: "UPS"}}
+	namedVia := CommandConfig{Name: "ups", Device: DeviceConfig{Name: "UPS", ViaDevice: "bridge"}}
+
+	tests := []struct {
+		name     string
+		commands []CommandConfig
+		cmd      CommandConfig
+		wantID   string
+		wantVia  string
+	}{
+		{"local command", []CommandConfig{local, remote}, local, "cmd", ""},
+		{"host device with instance device", []CommandConfig{local, remote}, remote, "cmd_nas", "cmd"},
+		{"host device without instance device", []CommandConfig{remote, named}, remote, "cmd_nas", ""},
+		{"named device with instance device", []CommandConfig{local, named}, named, "cmd_ups", "cmd"},
+		{"named device without instance device", []CommandConfig{remote, named}, named, "cmd_ups", ""},
+		{"named device keeps its via_device", []CommandConfig{remote, namedVia}, namedVia, "cmd_ups", "bridge"},
+		{"local target is the instance device", []CommandConfig{{Name: "df", TargetHost: "local"}, remote}, remote, "cmd_nas", "cmd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configureInstanceDevice(tt.commands)
+
+			device := deviceInfo(tt.cmd, "cmd")
+			if len(device.Identifiers) != 1 || device.Identifiers[0] != tt.wantID {
+				t.Errorf("deviceInfo() identifiers = %q, want [%q]", device.Identifiers, tt.wantID)
+			}
+			if device.ViaDevice != tt.wantVia {
+				t.Errorf("deviceInfo() via_device = %q, want %q", device.ViaDevice, tt.wantVia)
+			}
+		})
+	}
+}
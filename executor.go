@@ -1,113 +1,329 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
-// ExecuteCommandPeriodically runs a command at regular intervals
-func ExecuteCommandPeriodically(cmd CommandConfig, clientID string) {
-	frequency, err := time.ParseDuration(cmd.Frequency)
+// defaultCommandTimeout is used when neither the command nor the defaults block sets a timeout
+const defaultCommandTimeout = 60 * time.Second
+
+// CommandResult is the outcome of running a command once
+type CommandResult struct {
+	Output   string        // Trimmed command output
+	Stdout   string        // Trimmed stdout alone, which is what extractors parse
+	Stderr   string        // Trimmed stderr, which local commands also include in Output
+	ExitCode int           // Exit status, or -1 if the command didn't run to completion
+	Err      error         // Why the command failed, nil on success
+	State    string        // State published for plain sensors: the output, or an ERROR:/TIMEOUT: message
+	Duration time.Duration // How long the command ran
+}
+
+// ExecuteCommandPeriodically runs a command at regular intervals, first after
+// startDelay, or on its cron schedule, skipping runs outside its active window
+func ExecuteCommandPeriodically(cmd CommandConfig, clientID string, startDelay time.Duration) {
+	location, err := commandLocation(cmd)
+	if err != nil {
+		logger.Errorf("Invalid timezone for command %s: %v, using local time", cmd.Name, err)
+		location = time.Local
+	}
+
+	window, err := parseActiveWindow(cmd.ActiveHours, cmd.ActiveDays)
+	if err != nil {
+		logger.Errorf("Invalid active window for command %s: %v, running at all times", cmd.Name, err)
+	}
+
+	run := func() {
+		if !window.contains(time.Now().In(location)) {
+			logger.Debugf("Skipping %s outside its active window (%s)", cmd.Name, window)
+			return
+		}
+		time.Sleep(jitterDelay(cmd))
+		executePeriodicRun(cmd, clientID)
+	}
+
+	if cmd.Schedule != "" {
+		schedule, err := parseCron(cmd.Schedule)
+		if err != nil {
+			logger.Errorf("Invalid schedule for command %s: %v", cmd.Name, err)
+			return
+		}
+
+		// Scheduled commands only run at their scheduled times, not at startup
+		for {
+			next := schedule.Next(time.Now().In(location))
+			if next.IsZero() {
+				logger.Errorf("Schedule %q for command %s never fires", cmd.Schedule, cmd.Name)
+				return
+			}
+			logger.Debugf("Next run of %s at %s", cmd.Name, next.Format(time.RFC3339))
+			time.Sleep(time.Until(next))
+			run()
+		}
+	}
+
+	frequency, err := commandFrequency(cmd)
 	if err != nil {
 		logger.Errorf("Invalid frequency for command %s: %v", cmd.Name, err)
-		frequency = 60 * time.Second // Default to 60 seconds
+	}
+
+	if startDelay > 0 {
+		logger.Debugf("Starting %s in %s", cmd.Name, startDelay.Round(time.Millisecond))
+		time.Sleep(startDelay)
 	}
 
 	ticker := time.NewTicker(frequency)
 	defer ticker.Stop()
 
 	// Execute immediately
-	ExecuteCommand(cmd, clientID)
+	run()
 
 	// Then execute periodically
 	for range ticker.C {
-		ExecuteCommand(cmd, clientID)
+		run()
 	}
 }
 
-// ExecuteCommand executes a single command and publishes the result
+// executePeriodicRun runs a scheduled state read. Entities that Home
+// Assistant controls skip it while an action is in progress, since the read
+// could finish after the action's own read-back and publish a stale state.
+func executePeriodicRun(cmd CommandConfig, clientID string) {
+	if hasCommandTopic(cmd) {
+		lock := actionLock(cmd, clientID)
+		if !lock.TryLock() {
+			logger.Debugf("Skipping scheduled read of %s while an action is in progress", cmd.Name)
+			return
+		}
+		defer lock.Unlock()
+	}
+
+	ExecuteCommand(cmd, clientID)
+}
+
+// ExecuteCommand executes a single command and publishes the result to
+// every entity it feeds
 func ExecuteCommand(cmd CommandConfig, clientID string) {
+	result := RunCommand(cmd, stateCommand(cmd))
+
+	for _, entity := range entities(cmd) {
+		// Attributes describe the run, so they're published even when the state isn't
+		if hasAttributes(entity) {
+			PublishAttributes(entity, result, clientID)
+		}
+
+		state, ok := commandState(entity, result)
+		if !ok {
+			if state, ok = failureState(entity, state, clientID); !ok {
+				continue
+			}
+		} else if failurePolicy(entity) == OnFailureUnavailable {
+			PublishEntityAvailability(entity, clientID, availabilityOnline)
+		}
+
+		// Publish result to MQTT
+		PublishResult(entity, state, clientID)
+	}
+}
+
+// RunCommand runs one of cmd's commands locally or on its target host and
+// reports the outcome. The timeout and target host are taken from cmd.
+func RunCommand(cmd CommandConfig, command string) CommandResult {
 	logger.Debugf("Executing command: %s", cmd.Name)
 
-	var result string
+	timeout := commandTimeout(cmd)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
 	// Default to local execution if target_host is not specified or is "local"
-	if cmd.TargetHost != "" && cmd.TargetHost != "local" {
-		// Execute command via SSH
-		conn, exists := GetSSHConnection(cmd.TargetHost)
-		if !exists {
-			logger.Errorf("Target host %s not found for command %s", cmd.TargetHost, cmd.Name)
-			result = fmt.Sprintf("ERROR: Target host %s not configured", cmd.TargetHost)
-		} else {
-			// Check if connection is still alive, reconnect if needed
-			if !IsSSHConnectionAlive(conn) {
-				logger.Warnf("SSH connection to %s is dead, reconnecting...", cmd.TargetHost)
-				reconnectErr := ReconnectSSH(cmd.TargetHost)
-				if reconnectErr != nil {
-					logger.Errorf("Failed to reconnect to SSH host %s: %v", cmd.TargetHost, reconnectErr)
-					result = fmt.Sprintf("ERROR: Failed to reconnect to SSH host: %v", reconnectErr)
-				} else {
-					// Get the new connection
-					conn, _ = GetSSHConnection(cmd.TargetHost)
-				}
-			}
+	if cmd.TargetHost == "" || cmd.TargetHost == "local" {
+		return executeLocalCommand(ctx, cmd, command, timeout)
+	}
 
-			if conn != nil {
-				output, sshErr := ExecuteSSHCommand(conn, cmd.Command)
-				if sshErr != nil {
-					logger.Errorf("SSH command %s failed: %v", cmd.Name, sshErr)
-					result = fmt.Sprintf("ERROR: %v", sshErr)
-				} else {
-					result = strings.TrimSpace(output)
-				}
-			}
-		}
-	} else {
-		// Execute command locally
-		result = executeLocalCommand(cmd)
+	// Execute command via SSH
+	if _, exists := GetSSHConnection(cmd.TargetHost); !exists {
+		logger.Errorf("Target host %s not found for command %s", cmd.TargetHost, cmd.Name)
+		return failedResult(fmt.Errorf("target host %s not configured", cmd.TargetHost),
+			fmt.Sprintf("ERROR: Target host %s not configured", cmd.TargetHost))
+	}
+
+	conn, connErr := sshManager.Connection(cmd.TargetHost)
+	if connErr != nil {
+		logger.Errorf("Cannot run command %s: %v", cmd.Name, connErr)
+		return failedResult(connErr, fmt.Sprintf("ERROR: SSH host %s unreachable", cmd.TargetHost))
 	}
 
-	// Publish result to MQTT
-	PublishResult(cmd, result, clientID)
+	start := time.Now()
+	output, stderr, sshErr := ExecuteSSHCommand(ctx, conn, command)
+	result := CommandResult{
+		Output:   strings.TrimSpace(output),
+		Stdout:   strings.TrimSpace(output),
+		Stderr:   strings.TrimSpace(stderr),
+		Duration: time.Since(start),
+	}
+
+	var exitErr *ssh.ExitError
+	switch {
+	case errors.Is(sshErr, context.DeadlineExceeded):
+		return timeoutResult(cmd, timeout, result.Duration)
+	case errors.As(sshErr, &exitErr):
+		exitLogf(cmd)("SSH command %s failed: %v", cmd.Name, sshErr)
+		result.ExitCode = exitErr.ExitStatus()
+		result.Err = sshErr
+		result.State = fmt.Sprintf("ERROR: %v", sshErr)
+	case sshErr != nil:
+		logger.Errorf("SSH command %s failed: %v", cmd.Name, sshErr)
+		result.ExitCode = -1
+		result.Err = sshErr
+		result.State = fmt.Sprintf("ERROR: %v", sshErr)
+	default:
+		result.State = result.Output
+	}
+
+	return result
 }
 
-func executeLocalCommand(cmd CommandConfig) string {
-	if strings.TrimSpace(cmd.Command) == "" {
+func executeLocalCommand(ctx context.Context, cmd CommandConfig, command string, timeout time.Duration) CommandResult {
+	if strings.TrimSpace(command) == "" {
 		logger.Errorf("Empty command for %s", cmd.Name)
-		return "ERROR: Empty command"
+		return failedResult(errors.New("empty command"), "ERROR: Empty command")
 	}
 
 	// Execute command using shell for proper interpretation of pipes, redirects, etc.
-	execCmd := exec.Command("sh", "-c", cmd.Command)
+	execCmd := exec.CommandContext(ctx, "sh", "-c", command)
+
+	// Run in its own process group so a timeout kills the whole pipeline, not just the shell
+	setProcessGroup(execCmd)
+
+	// Don't wait forever on pipes held open by grandchildren that escaped the kill
+	execCmd.WaitDelay = 5 * time.Second
+
+	// Capture both stdout and stderr, keeping each on its own as well
+	var output outputCapture
+	execCmd.Stdout = captureWriter{capture: &output}
+	execCmd.Stderr = captureWriter{capture: &output, stderr: true}
 
-	// Capture both stdout and stderr
-	output, err := execCmd.CombinedOutput()
+	start := time.Now()
+	err := execCmd.Run()
+	elapsed := time.Since(start)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return timeoutResult(cmd, timeout, elapsed)
+	}
+
+	result := CommandResult{
+		Output:   strings.TrimSpace(output.combined.String()),
+		Stdout:   strings.TrimSpace(output.stdout.String()),
+		Stderr:   strings.TrimSpace(output.stderr.String()),
+		Duration: elapsed,
+	}
 
 	if err != nil {
-		outputStr := strings.TrimSpace(string(output))
+		outputStr := result.Output
+
+		result.Err = err
+		result.ExitCode = -1
+		logf := logger.Errorf
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+			logf = exitLogf(cmd)
+		}
 
 		// Log the full output for debugging, especially if it's multi-line
 		if strings.Contains(outputStr, "\n") {
-			logger.Errorf("Command %s failed: %v\nFull output:\n%s", cmd.Name, err, outputStr)
+			logf("Command %s failed: %v\nFull output:\n%s", cmd.Name, err, outputStr)
 		} else {
-			logger.Errorf("Command %s failed: %v - (output: %s)", cmd.Name, err, outputStr)
+			logf("Command %s failed: %v - (output: %s)", cmd.Name, err, outputStr)
 		}
 
 		// Return the actual output if available, otherwise return error
 		if outputStr != "" {
-			return fmt.Sprintf("ERROR: %s", outputStr)
+			result.State = fmt.Sprintf("ERROR: %s", outputStr)
+		} else {
+			result.State = fmt.Sprintf("ERROR: %v", err)
 		}
-		return fmt.Sprintf("ERROR: %v", err)
+		return result
 	}
 
-	result := strings.TrimSpace(string(output))
-
 	// Log multi-line outputs for debugging
-	if strings.Contains(result, "\n") {
-		logger.Debugf("Command %s produced multi-line output:\n%s", cmd.Name, result)
+	if strings.Contains(result.Output, "\n") {
+		logger.Debugf("Command %s produced multi-line output:\n%s", cmd.Name, result.Output)
 	}
 
+	result.State = result.Output
 	return result
-}
\ No newline at end of file
+}
+
+// outputCapture collects a local command's combined output, its stdout and its stderr
+type outputCapture struct {
+	mu       sync.Mutex
+	combined bytes.Buffer
+	stdout   bytes.Buffer
+	stderr   bytes.Buffer
+}
+
+// captureWriter writes one of a command's streams to an outputCapture
+type captureWriter struct {
+	capture *outputCapture
+	stderr  bool
+}
+
+func (w captureWriter) Write(p []byte) (int, error) {
+	w.capture.mu.Lock()
+	defer w.capture.mu.Unlock()
+
+	if w.stderr {
+		w.capture.stderr.Write(p)
+	} else {
+		w.capture.stdout.Write(p)
+	}
+	return w.capture.combined.Write(p)
+}
+
+// commandTimeout returns the configured timeout for a command, falling back to the default
+func commandTimeout(cmd CommandConfig) time.Duration {
+	if cmd.Timeout == "" {
+		return defaultCommandTimeout
+	}
+
+	timeout, err := time.ParseDuration(cmd.Timeout)
+	if err != nil || timeout <= 0 {
+		logger.Errorf("Invalid timeout for command %s: %q, using %s", cmd.Name, cmd.Timeout, defaultCommandTimeout)
+		return defaultCommandTimeout
+	}
+	return timeout
+}
+
+// exitLogf returns the logger for a command exiting non-zero. For entities
+// whose state comes from the exit code that's an ordinary outcome.
+func exitLogf(cmd CommandConfig) func(format string, args ...interface{}) {
+	switch componentOf(cmd) {
+	case ComponentBinarySensor, ComponentSwitch:
+		return logger.Debugf
+	}
+	return logger.Errorf
+}
+
+// failedResult is the result of a command that couldn't be run at all
+func failedResult(err error, state string) CommandResult {
+	return CommandResult{ExitCode: -1, Err: err, State: state}
+}
+
+// timeoutResult logs a timed out command and returns its result
+func timeoutResult(cmd CommandConfig, timeout, elapsed time.Duration) CommandResult {
+	logger.Errorf("Command %s timed out after %s (timeout: %s)", cmd.Name, elapsed.Round(time.Millisecond), timeout)
+	return CommandResult{
+		ExitCode: -1,
+		Err:      fmt.Errorf("timed out after %s", timeout),
+		State:    fmt.Sprintf("TIMEOUT: command exceeded %s", timeout),
+		Duration: elapsed,
+	}
+}
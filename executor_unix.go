@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in a new process group and kills the
+// entire group when the command's context is cancelled
+func setProcessGroup(execCmd *exec.Cmd) {
+	execCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	execCmd.Cancel = func() error {
+		// A negative PID signals every process in the group
+		return syscall.Kill(-execCmd.Process.Pid, syscall.SIGKILL)
+	}
+}
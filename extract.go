@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// ValueExtractor picks the value to publish out of a command's output. At
+// most one of the fields may be set.
+type ValueExtractor struct {
+	ValueJSON     string `yaml:"value_json,omitempty"`     // path into JSON output, e.g. "0.State.Status" or "$.items[2].name"
+	ValueRegex    string `yaml:"value_regex,omitempty"`    // first capture group (or the whole match) of this regex
+	ValueTemplate string `yaml:"value_template,omitempty"` // Go text/template rendered with .Output and .JSON
+}
+
+// templateData is what a value_template is rendered with
+type templateData struct {
+	Output string      // Trimmed command output
+	JSON   interface{} // Output decoded as JSON, nil if it isn't JSON
+}
+
+// templates caches parsed value templates by their source
+var templates sync.Map
+
+// templateFuncs are the helpers available in value templates
+var templateFuncs = template.FuncMap{
+	"trim":    strings.TrimSpace,
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": strings.ReplaceAll,
+	"split":   strings.Split,
+	"float":   toFloat,
+	"int":     func(v interface{}) (int64, error) { f, err := toFloat(v); return int64(f), err },
+	"round": func(places int, v interface{}) (float64, error) {
+		f, err := toFloat(v)
+		scale := math.Pow(10, float64(places))
+		return math.Round(f*scale) / scale, err
+	},
+	"add": func(a, b interface{}) (float64, error) {
+		return floatOp(a, b, func(x, y float64) float64 { return x + y })
+	},
+	"sub": func(a, b interface{}) (float64, error) {
+		return floatOp(a, b, func(x, y float64) float64 { return x - y })
+	},
+	"mul": func(a, b interface{}) (float64, error) {
+		return floatOp(a, b, func(x, y float64) float64 { return x * y })
+	},
+	"div": func(a, b interface{}) (float64, error) {
+		return floatOp(a, b, func(x, y float64) float64 { return x / y })
+	},
+	"path": func(path string, data interface{}) (string, error) {
+		value, err := lookupJSONPath(data, path)
+		if err != nil {
+			return "", err
+		}
+		return formatJSONValue(value)
+	},
+}
+
+// hasExtractor reports whether any extractor is configured
+func (e ValueExtractor) hasExtractor() bool {
+	return e.ValueJSON != "" || e.ValueRegex != "" || e.ValueTemplate != ""
+}
+
+// validate checks that at most one extractor is set and that it compiles
+func (e ValueExtractor) validate() error {
+	set := 0
+	for _, field := range []string{e.ValueJSON, e.ValueRegex, e.ValueTemplate} {
+		if field != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return errors.New("only one of value_json, value_regex and value_template can be set")
+	}
+
+	if e.ValueRegex != "" {
+		if _, err := compilePattern(e.ValueRegex); err != nil {
+			return fmt.Errorf("invalid value_regex: %v", err)
+		}
+	}
+	if e.ValueTemplate != "" {
+		if _, err := compileTemplate(e.ValueTemplate); err != nil {
+			return fmt.Errorf("invalid value_template: %v", err)
+		}
+	}
+	return nil
+}
+
+// extract applies the configured extractor to a command's output. Without
+// an extractor the output is returned unchanged.
+func (e ValueExtractor) extract(output string) (string, error) {
+	switch {
+	case e.ValueJSON != "":
+		data, err := decodeJSON(output)
+		if err != nil {
+			return "", fmt.Errorf("output is not JSON: %v", err)
+		}
+		value, err := lookupJSONPath(data, e.ValueJSON)
+		if err != nil {
+			return "", err
+		}
+		return formatJSONValue(value)
+
+	case e.ValueRegex != "":
+		re, err := compilePattern(e.ValueRegex)
+		if err != nil {
+			return "", err
+		}
+		match := re.FindStringSubmatch(output)
+		if match == nil {
+			return "", fmt.Errorf("output does not match %q", e.ValueRegex)
+		}
+		if len(match) > 1 {
+			return match[1], nil
+		}
+		return match[0], nil
+
+	case e.ValueTemplate != "":
+		tmpl, err := compileTemplate(e.ValueTemplate)
+		if err != nil {
+			return "", err
+		}
+		data := templateData{Output: output}
+		data.JSON, _ = decodeJSON(output)
+
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(rendered.String()), nil
+	}
+
+	return output, nil
+}
+
+// compileTemplate parses a value template once and reuses it afterwards
+func compileTemplate(source string) (*template.Template, error) {
+	if tmpl, ok := templates.Load(source); ok {
+		return tmpl.(*template.Template), nil
+	}
+
+	tmpl, err := template.New("value").Funcs(templateFuncs).Option("missingkey=error").Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	templates.Store(source, tmpl)
+	return tmpl, nil
+}
+
+// decodeJSON decodes command output, keeping numbers as written
+func decodeJSON(output string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(output))
+	decoder.UseNumber()
+
+	var data interface{}
+	if err := decoder.Decode(&data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// lookupJSONPath evaluates a gjson style path ("items.0.name", "items.#",
+// "items.#.name") or its JSONPath spelling ("$.items[0].name") against
+// decoded JSON. A "#" segment is the length of an array, or maps the rest of
+// the path over its elements.
+func lookupJSONPath(data interface{}, path string) (interface{}, error) {
+	path = strings.TrimPrefix(path, "$")
+	path = strings.ReplaceAll(path, "[", ".")
+	path = strings.ReplaceAll(path, "]", "")
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return data, nil
+	}
+	return lookupSegments(data, splitJSONPath(path), "")
+}
+
+func lookupSegments(data interface{}, segments []string, walked string) (interface{}, error) {
+	if len(segments) == 0 {
+		return data, nil
+	}
+
+	segment, rest := segments[0], segments[1:]
+	location := strings.TrimPrefix(walked+"."+segment, ".")
+
+	switch value := data.(type) {
+	case map[string]interface{}:
+		child, exists := value[segment]
+		if !exists {
+			return nil, fmt.Errorf("no field %q in output", location)
+		}
+		return lookupSegments(child, rest, location)
+
+	case []interface{}:
+		if segment == "#" {
+			if len(rest) == 0 {
+				return json.Number(strconv.Itoa(len(value))), nil
+			}
+			mapped := make([]interface{}, 0, len(value))
+			for i, element := range value {
+				child, err := lookupSegments(element, rest, fmt.Sprintf("%s.%d", walked, i))
+				if err != nil {
+					return nil, err
+				}
+				mapped = append(mapped, child)
+			}
+			return mapped, nil
+		}
+
+		index, err := strconv.Atoi(segment)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %q is not an array index", location, segment)
+		}
+		if index < 0 {
+			index += len(value)
+		}
+		if index < 0 || index >= len(value) {
+			return nil, fmt.Errorf("%q: index out of range (length %d)", location, len(value))
+		}
+		return lookupSegments(value[index], rest, location)
+	}
+
+	return nil, fmt.Errorf("%q: cannot look up %q in a %s", location, segment, jsonKind(data))
+}
+
+// splitJSONPath splits a path on dots, allowing "\." inside keys
+func splitJSONPath(path string) []string {
+	var segments []string
+	var current strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\\' && i+1 < len(path):
+			i++
+			current.WriteByte(path[i])
+		case path[i] == '.':
+			segments = append(segments, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(path[i])
+		}
+	}
+	return append(segments, current.String())
+}
+
+// formatJSONValue renders a looked up value for publishing: strings and
+// numbers as they are, objects and arrays as compact JSON
+func formatJSONValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", errors.New("value is null")
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// jsonKind names the JSON type of a decoded value for error messages
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+// toFloat converts template values (numbers, JSON numbers, strings) to float64
+func toFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return 0, fmt.Errorf("cannot convert %v to a number", value)
+}
+
+func floatOp(a, b interface{}, op func(x, y float64) float64) (float64, error) {
+	x, err := toFloat(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := toFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	return op(x, y), nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLookupJSONPath(t *testing.T) {
+	const document = `{
+		"name": "nas",
+		"load": 0.25,
+		"up": true,
+		"missing": null,
+		"disks": [
+			{"name": "sda", "used": 40},
+			{"name": "sdb", "used": 75}
+		],
+		"tags": ["a", "b", "c"],
+		"nested": {"deep": {"value": 1e3}},
+		"dotted.key": "dot",
+		"empty": []
+	}`
+
+	data, err := decodeJSON(document)
+	if err != nil {
+		t.Fatalf("decodeJSON() error = %v", err)
+	}
+
+	tests := []struct {
+		path    string
+		want    string // the result encoded as JSON
+		wantErr bool
+	}{
+		{"name", `"nas"`, false},
+		{"load", `0.25`, false},
+		{"up", `true`, false},
+		{"missing", `null`, false},
+		{"nested.deep.value", `1e3`, false},
+		{"nested", `{"deep":{"value":1e3}}`, false},
+		{"disks.0.name", `"sda"`, false},
+		{"disks.1.used", `75`, false},
+		{"disks.-1.name", `"sdb"`, false},
+		{"tags.-3", `"a"`, false},
+		{"disks.#", `2`, false},
+		{"empty.#", `0`, false},
+		{"disks.#.name", `["sda","sdb"]`, false},
+		{"empty.#.name", `[]`, false},
+		{"$.disks[1].name", `"sdb"`, false},
+		{"$.tags[0]", `"a"`, false},
+		{"$", document, false},
+		{"", document, false},
+		{`dotted\.key`, `"dot"`, false},
+		{"nope", "", true},
+		{"nested.nope", "", true},
+		{"disks.2", "", true},
+		{"tags.-4", "", true},
+		{"disks.first", "", true},
+		{"name.length", "", true},
+		{"disks.#.size", "", true},
+		{"load.#", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := lookupJSONPath(data, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookupJSONPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			gotJSON, err := json.Marshal(got)
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			want, err := decodeJSON(tt.want)
+			if err != nil {
+				t.Fatalf("decodeJSON(%q) error = %v", tt.want, err)
+			}
+			wantJSON, _ := json.Marshal(want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("lookupJSONPath(%q) = %s, want %s", tt.path, gotJSON, wantJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+)
+
+// What to publish when a command fails or its output can't be parsed
+const (
+	OnFailureError       = "error"       // publish the ERROR:/TIMEOUT: text as the state
+	OnFailureNone        = "none"        // publish nothing, keeping the previous state
+	OnFailureUnavailable = "unavailable" // mark the entity unavailable until the next successful run
+	OnFailureFallback    = "fallback"    // publish fallback_value
+)
+
+// failurePolicy returns a command's on_failure setting. Sensors publish the
+// error text by default; other entities can't show it, so they keep their
+// previous state.
+func failurePolicy(cmd CommandConfig) string {
+	if cmd.OnFailure != "" {
+		return cmd.OnFailure
+	}
+	if componentOf(cmd) == ComponentSensor {
+		return OnFailureError
+	}
+	return OnFailureNone
+}
+
+// validateFailurePolicy checks a command's on_failure and fallback_value
+func validateFailurePolicy(cmd CommandConfig) error {
+	switch cmd.OnFailure {
+	case "", OnFailureError, OnFailureNone, OnFailureUnavailable:
+	case OnFailureFallback:
+		if cmd.FallbackValue == "" {
+			return fmt.Errorf("command %s: on_failure fallback needs a fallback_value", cmd.Name)
+		}
+	default:
+		return fmt.Errorf("command %s: unknown on_failure %q", cmd.Name, cmd.OnFailure)
+	}
+	return nil
+}
+
+// failureState applies an entity's on_failure policy to a failed run. It
+// returns the state to publish, or false if nothing should be published.
+func failureState(cmd CommandConfig, errorState string, clientID string) (string, bool) {
+	switch failurePolicy(cmd) {
+	case OnFailureNone:
+		logger.Warnf("Not updating %s after a failed run", cmd.Name)
+		return "", false
+	case OnFailureUnavailable:
+		PublishEntityAvailability(cmd, clientID, availabilityOffline)
+		return "", false
+	case OnFailureFallback:
+		return cmd.FallbackValue, true
+	}
+	return errorState, true
+}
+
+// entityAvailabilityTopic returns the topic marking a single entity
+// available, used by commands with on_failure: unavailable
+func entityAvailabilityTopic(cmd CommandConfig, clientID string) string {
+	return fmt.Sprintf("%s/%s/%s/availability", topicSettings.prefix, componentOf(cmd), sensorID(cmd, clientID))
+}
+
+// PublishEntityAvailability marks an entity online or offline. Only changes
+// are published; replayDiscovery re-sends the last one.
+func PublishEntityAvailability(cmd CommandConfig, clientID string, state string) {
+	announcedMu.Lock()
+	if sensor, exists := announced[sensorID(cmd, clientID)]; exists {
+		if sensor.availability == state {
+			announcedMu.Unlock()
+			return
+		}
+		sensor.availability = state
+	}
+	announcedMu.Unlock()
+
+	if state == availabilityOffline {
+		logger.Warnf("Marking %s unavailable after a failed run", cmd.Name)
+	} else {
+		logger.Infof("Marking %s available", cmd.Name)
+	}
+	publishEntityAvailability(cmd, clientID, state)
+}
+
+// publishEntityAvailability publishes an entity's availability, retained so
+// Home Assistant picks it up after a restart
+func publishEntityAvailability(cmd CommandConfig, clientID string, state string) {
+	if !mqttClient.IsConnectionOpen() {
+		// Re-sent by replayDiscovery on reconnect
+		return
+	}
+
+	token := mqttClient.Publish(entityAvailabilityTopic(cmd, clientID), 1, true, state)
+	if token.Wait() && token.Error() != nil {
+		logger.Errorf("Failed to publish availability of %s: %v", cmd.Name, token.Error())
+	}
+}
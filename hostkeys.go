@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key verification modes for SSHHost.HostKeyVerification
+const (
+	HostKeyKnownHosts = "known_hosts"
+	HostKeyTOFU       = "tofu"
+	HostKeyInsecure   = "insecure"
+)
+
+// knownHostsMu serializes writes to known_hosts files in trust-on-first-use mode
+var knownHostsMu sync.Mutex
+
+// stateDirName is the directory under $XDG_STATE_HOME (or ~/.local/state)
+// used when ssh.state_dir isn't set
+const stateDirName = "ha-command-to-mqtt"
+
+// hostKeyCallback builds the host key verification for a host. A pinned
+// fingerprint takes precedence over known_hosts; otherwise the known_hosts
+// file is consulted and, in tofu mode, unknown hosts are recorded to it.
+// Without a configured known_hosts, tofu mode records to a known_hosts file
+// in stateDir and only reads the user's ~/.ssh/known_hosts.
+// It also returns the host key algorithms to offer so the server presents a
+// key type we actually have on record.
+func hostKeyCallback(hostConfig SSHHost, addr, stateDir string) (ssh.HostKeyCallback, []string, error) {
+	if hostConfig.HostKeyFingerprint != "" {
+		keyType, fingerprint, err := parseFingerprint(hostConfig.HostKeyFingerprint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid host_key_fingerprint for host %s: %v", hostConfig.Name, err)
+		}
+		// Ask for the pinned key type, or without one prefer the types in
+		// OpenSSH's order, so the server presents the key the pin came from
+		algorithms := pinnedKeyAlgorithms
+		if keyType != "" {
+			algorithms = keyAlgorithms(keyType)
+		}
+		return fingerprintCallback(hostConfig.Name, fingerprint), algorithms, nil
+	}
+
+	mode := hostConfig.HostKeyVerification
+	if mode == "" {
+		mode = HostKeyKnownHosts
+	}
+
+	switch mode {
+	case HostKeyInsecure:
+		logger.Warnf("Host key verification disabled for SSH host %s", hostConfig.Name)
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	case HostKeyKnownHosts, HostKeyTOFU:
+	default:
+		return nil, nil, fmt.Errorf("unknown host_key_verification %q for host %s", mode, hostConfig.Name)
+	}
+
+	path, err := knownHostsPath(hostConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := []string{path}
+
+	if mode == HostKeyTOFU {
+		if hostConfig.KnownHosts == "" {
+			// Keys learned on first use go to our own file, never the user's
+			if stateDir == "" {
+				return nil, nil, fmt.Errorf("no state directory to record host keys for %s in, set ssh.state_dir or known_hosts", hostConfig.Name)
+			}
+			files = []string{filepath.Join(stateDir, "known_hosts")}
+			if _, err := os.Stat(path); err == nil {
+				files = append(files, path)
+			}
+			path = files[0]
+		}
+		if err := ensureKnownHostsFile(path); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	verify, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load known_hosts file %s: %v", strings.Join(files, ", "), err)
+	}
+
+	algorithms := knownHostKeyAlgorithms(verify, addr)
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := verify(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if err == nil || !errors.As(err, &keyErr) {
+			return err
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+		if len(keyErr.Want) > 0 {
+			logger.Errorf("Host key mismatch for SSH host %s (%s): server presented %s %s, refusing connection",
+				hostConfig.Name, hostname, key.Type(), fingerprint)
+			return fmt.Errorf("host key mismatch for %s: %s", hostname, fingerprint)
+		}
+
+		if mode != HostKeyTOFU {
+			logger.Errorf("Unknown host key for SSH host %s (%s): %s %s is not in %s",
+				hostConfig.Name, hostname, key.Type(), fingerprint, path)
+			return fmt.Errorf("host %s not found in %s", hostname, path)
+		}
+
+		if err := appendKnownHost(path, hostname, remote, key); err != nil {
+			return err
+		}
+		logger.Warnf("Trusting SSH host %s (%s) on first use: %s %s recorded to %s",
+			hostConfig.Name, hostname, key.Type(), fingerprint, path)
+		return nil
+	}
+
+	return callback, algorithms, nil
+}
+
+// pinnedKeyAlgorithms is the host key preference for a pin without a key
+// type. It follows OpenSSH's order, so a fingerprint copied from ssh's first
+// connection prompt matches the key the server presents to us.
+var pinnedKeyAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+}
+
+// parseFingerprint splits a pin such as "ssh-ed25519 SHA256:abc" into its
+// optional key type and the base64 fingerprint
+func parseFingerprint(pin string) (string, string, error) {
+	fields := strings.Fields(pin)
+	keyType := ""
+	switch len(fields) {
+	case 1:
+	case 2:
+		keyType = fields[0]
+		if keyAlgorithms(keyType) == nil {
+			return "", "", fmt.Errorf("unsupported key type %q", keyType)
+		}
+	default:
+		return "", "", fmt.Errorf("expected \"[key type] SHA256:fingerprint\", got %q", pin)
+	}
+
+	fingerprint := strings.TrimPrefix(fields[len(fields)-1], "SHA256:")
+	if fingerprint == "" {
+		return "", "", fmt.Errorf("empty fingerprint")
+	}
+	return keyType, fingerprint, nil
+}
+
+// keyAlgorithms returns the host key algorithms that present a key of
+// keyType, or nil for a type we can't ask for
+func keyAlgorithms(keyType string) []string {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return []string{keyType}
+	default:
+		return nil
+	}
+}
+
+// fingerprintCallback accepts only a host key matching the pinned SHA256 fingerprint
+func fingerprintCallback(hostName, want string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		if strings.TrimPrefix(fingerprint, "SHA256:") != want {
+			logger.Errorf("Host key mismatch for SSH host %s (%s): server presented %s %s, expected SHA256:%s",
+				hostName, hostname, key.Type(), fingerprint, want)
+			return fmt.Errorf("host key mismatch for %s: %s", hostname, fingerprint)
+		}
+		return nil
+	}
+}
+
+// knownHostsPath returns the configured known_hosts path or ~/.ssh/known_hosts
+func knownHostsPath(hostConfig SSHHost) (string, error) {
+	if hostConfig.KnownHosts != "" {
+		return expandHome(hostConfig.KnownHosts)
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine home directory for known_hosts: %v", err)
+	}
+	return filepath.Join(homeDir, ".ssh", "known_hosts"), nil
+}
+
+// sshStateDir returns ssh.state_dir, or $XDG_STATE_HOME/ha-command-to-mqtt
+// and then ~/.local/state/ha-command-to-mqtt when it isn't set
+func sshStateDir(config SSHConfig) (string, error) {
+	if config.StateDir != "" {
+		return expandHome(config.StateDir)
+	}
+	if stateHome := os.Getenv("XDG_STATE_HOME"); stateHome != "" {
+		return filepath.Join(stateHome, stateDirName), nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine home directory for the SSH state directory, set ssh.state_dir: %v", err)
+	}
+	return filepath.Join(homeDir, ".local", "state", stateDirName), nil
+}
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not expand %s: %v", path, err)
+	}
+	return filepath.Join(homeDir, strings.TrimPrefix(path, "~")), nil
+}
+
+// ensureKnownHostsFile creates an empty known_hosts file if it doesn't exist yet
+func ensureKnownHostsFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create known_hosts file %s: %v", path, err)
+	}
+	return file.Close()
+}
+
+// appendKnownHost records a host key to a known_hosts file
+func appendKnownHost(path, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil {
+		if remoteAddr := knownhosts.Normalize(remote.String()); remoteAddr != addresses[0] {
+			addresses = append(addresses, remoteAddr)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known_hosts file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintln(file, knownhosts.Line(addresses, key)); err != nil {
+		return fmt.Errorf("failed to write known_hosts file %s: %v", path, err)
+	}
+	return nil
+}
+
+// knownHostKeyAlgorithms returns the key algorithms recorded for addr, so the
+// server is asked for a key type that can actually be verified. It returns nil
+// when the host is unknown, leaving the client's defaults in place.
+func knownHostKeyAlgorithms(verify ssh.HostKeyCallback, addr string) []string {
+	// Probing with a key that can never match makes knownhosts report every
+	// key it has on record for the host
+	var keyErr *knownhosts.KeyError
+	if err := verify(addr, &net.TCPAddr{}, probeKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, known := range keyErr.Want {
+		candidates := keyAlgorithms(known.Key.Type())
+		if candidates == nil {
+			candidates = []string{known.Key.Type()}
+		}
+		for _, algorithm := range candidates {
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+	return algorithms
+}
+
+// probeKey is a placeholder public key used to query known_hosts
+type probeKey struct{}
+
+func (probeKey) Type() string                        { return "probe" }
+func (probeKey) Marshal() []byte                     { return []byte("probe") }
+func (probeKey) Verify([]byte, *ssh.Signature) error { return errors.New("probe key cannot verify") }
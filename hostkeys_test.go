@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newED25519Key(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error = %v", err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey() error = %v", err)
+	}
+	return key
+}
+
+func newECDSAKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() error = %v", err)
+	}
+	key, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey() error = %v", err)
+	}
+	return key
+}
+
+func writeKnownHosts(t *testing.T, lines ...string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	content := ""
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return path
+}
+
+const testHostAddr = "server.example.com:22"
+
+var testRemoteAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 22}
+
+func TestParseFingerprint(t *testing.T) {
+	tests := []struct {
+		pin             string
+		wantType        string
+		wantFingerprint string
+		wantErr         bool
+	}{
+		{"SHA256:abc", "", "abc", false},
+		{"abc", "", "abc", false},
+		{"  SHA256:abc  ", "", "abc", false},
+		{"ssh-ed25519 SHA256:abc", ssh.KeyAlgoED25519, "abc", false},
+		{"ecdsa-sha2-nistp256 SHA256:abc", ssh.KeyAlgoECDSA256, "abc", false},
+		{"ssh-rsa abc", ssh.KeyAlgoRSA, "abc", false},
+		{"ssh-foo SHA256:abc", "", "", true},
+		{"ssh-ed25519 SHA256:abc extra", "", "", true},
+		{"SHA256:", "", "", true},
+	}
+
+	for _, tt := range tests {
+		keyType, fingerprint, err := parseFingerprint(tt.pin)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFingerprint(%q) error = %v, wantErr %v", tt.pin, err, tt.wantErr)
+			continue
+		}
+		if keyType != tt.wantType || fingerprint != tt.wantFingerprint {
+			t.Errorf("parseFingerprint(%q) = %q, %q, want %q, %q", tt.pin, keyType, fingerprint, tt.wantType, tt.wantFingerprint)
+		}
+	}
+}
+
+func TestHostKeyCallbackPinned(t *testing.T) {
+	quietLogger(t)
+
+	key := newED25519Key(t)
+	other := newECDSAKey(t)
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	tests := []struct {
+		name           string
+		pin            string
+		key            ssh.PublicKey
+		wantAlgorithms []string
+		wantErr        bool
+	}{
+		{"typed pin matches", "ssh-ed25519 " + fingerprint, key, []string{ssh.KeyAlgoED25519}, false},
+		{"untyped pin matches", fingerprint, key, pinnedKeyAlgorithms, false},
+		{"pin without SHA256 prefix", fingerprint[len("SHA256:"):], key, pinnedKeyAlgorithms, false},
+		{"rsa pin asks for every rsa signature", "ssh-rsa " + fingerprint, key,
+			[]string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}, false},
+		{"different key is refused", "ssh-ed25519 " + fingerprint, other, []string{ssh.KeyAlgoED25519}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := SSHHost{Name: "server", HostKeyFingerprint: tt.pin}
+			callback, algorithms, err := hostKeyCallback(host, testHostAddr, "")
+			if err != nil {
+				t.Fatalf("hostKeyCallback() error = %v", err)
+			}
+			if !reflect.DeepEqual(algorithms, tt.wantAlgorithms) {
+				t.Errorf("hostKeyCallback() algorithms = %q, want %q", algorithms, tt.wantAlgorithms)
+			}
+			if err := callback(testHostAddr, testRemoteAddr, tt.key); (err != nil) != tt.wantErr {
+				t.Errorf("callback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, _, err := hostKeyCallback(SSHHost{Name: "server", HostKeyFingerprint: "ssh-foo " + fingerprint}, testHostAddr, ""); err == nil {
+		t.Error("hostKeyCallback() with an unsupported key type succeeded")
+	}
+}
+
+func TestHostKeyCallbackKnownHosts(t *testing.T) {
+	quietLogger(t)
+
+	key := newED25519Key(t)
+	other := newED25519Key(t)
+	path := writeKnownHosts(t, knownhosts.Line([]string{knownhosts.Normalize(testHostAddr)}, key))
+
+	callback, algorithms, err := hostKeyCallback(SSHHost{Name: "server", KnownHosts: path}, testHostAddr, "")
+	if err != nil {
+		t.Fatalf("hostKeyCallback() error = %v", err)
+	}
+	if want := []string{ssh.KeyAlgoED25519}; !reflect.DeepEqual(algorithms, want) {
+		t.Errorf("hostKeyCallback() algorithms = %q, want %q", algorithms, want)
+	}
+
+	tests := []struct {
+		name     string
+		hostname string
+		key      ssh.PublicKey
+		wantErr  bool
+	}{
+		{"known key", testHostAddr, key, false},
+		{"changed key", testHostAddr, other, true},
+		{"unknown host", "other.example.com:22", key, true},
+	}
+
+	for _, tt := range tests {
+		if err := callback(tt.hostname, testRemoteAddr, tt.key); (err != nil) != tt.wantErr {
+			t.Errorf("%s: callback() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// Verification never records anything outside tofu mode
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("known_hosts has %d line(s), want 1", lines)
+	}
+
+	if _, _, err := hostKeyCallback(SSHHost{Name: "server", KnownHosts: filepath.Join(t.TempDir(), "missing")}, testHostAddr, ""); err == nil {
+		t.Error("hostKeyCallback() with a missing known_hosts file succeeded")
+	}
+}
+
+func TestHostKeyCallbackTOFU(t *testing.T) {
+	quietLogger(t)
+
+	key := newED25519Key(t)
+	other := newED25519Key(t)
+	path := filepath.Join(t.TempDir(), "state", "known_hosts")
+	host := SSHHost{Name: "server", KnownHosts: path, HostKeyVerification: HostKeyTOFU}
+
+	// The first connection records the key, creating the file
+	callback, algorithms, err := hostKeyCallback(host, testHostAddr, "")
+	if err != nil {
+		t.Fatalf("hostKeyCallback() error = %v", err)
+	}
+	if algorithms != nil {
+		t.Errorf("hostKeyCallback() algorithms for an unknown host = %q, want nil", algorithms)
+	}
+	if err := callback(testHostAddr, testRemoteAddr, key); err != nil {
+		t.Fatalf("callback() on first use error = %v", err)
+	}
+
+	// Later connections only accept the recorded key
+	callback, algorithms, err = hostKeyCallback(host, testHostAddr, "")
+	if err != nil {
+		t.Fatalf("hostKeyCallback() error = %v", err)
+	}
+	if want := []string{ssh.KeyAlgoED25519}; !reflect.DeepEqual(algorithms, want) {
+		t.Errorf("hostKeyCallback() algorithms = %q, want %q", algorithms, want)
+	}
+	if err := callback(testHostAddr, testRemoteAddr, key); err != nil {
+		t.Errorf("callback() with the recorded key error = %v", err)
+	}
+	if err := callback(testHostAddr, testRemoteAddr, other); err == nil {
+		t.Error("callback() with a changed key succeeded")
+	}
+}
+
+func TestHostKeyCallbackTOFUStateDir(t *testing.T) {
+	quietLogger(t)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	userKey := newED25519Key(t)
+	learnedKey := newED25519Key(t)
+
+	// The user's known_hosts is read but never written
+	userKnownHosts := filepath.Join(home, ".ssh", "known_hosts")
+	if err := os.MkdirAll(filepath.Dir(userKnownHosts), 0700); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	userLine := knownhosts.Line([]string{knownhosts.Normalize(testHostAddr)}, userKey) + "\n"
+	if err := os.WriteFile(userKnownHosts, []byte(userLine), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	stateDir := filepath.Join(t.TempDir(), "state")
+	host := SSHHost{Name: "server", HostKeyVerification: HostKeyTOFU}
+
+	callback, _, err := hostKeyCallback(host, testHostAddr, stateDir)
+	if err != nil {
+		t.Fatalf("hostKeyCallback() error = %v", err)
+	}
+	if err := callback(testHostAddr, testRemoteAddr, userKey); err != nil {
+		t.Errorf("callback() with a key from ~/.ssh/known_hosts error = %v", err)
+	}
+	if err := callback("new.example.com:22", testRemoteAddr, learnedKey); err != nil {
+		t.Fatalf("callback() on first use error = %v", err)
+	}
+
+	data, err := os.ReadFile(userKnownHosts)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(data) != userLine {
+		t.Errorf("~/.ssh/known_hosts was modified: %q", data)
+	}
+	data, err = os.ReadFile(filepath.Join(stateDir, "known_hosts"))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !strings.Contains(string(data), knownhosts.Normalize("new.example.com:22")) {
+		t.Errorf("state known_hosts = %q, want the learned host", data)
+	}
+
+	if _, _, err := hostKeyCallback(host, testHostAddr, ""); err == nil {
+		t.Error("hostKeyCallback() in tofu mode without a state directory succeeded")
+	}
+}
+
+func TestSSHStateDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	tests := []struct {
+		name         string
+		config       SSHConfig
+		xdgStateHome string
+		want         string
+	}{
+		{"configured", SSHConfig{StateDir: "/data"}, "/xdg", "/data"},
+		{"configured under home", SSHConfig{StateDir: "~/state"}, "", filepath.Join(home, "state")},
+		{"XDG_STATE_HOME", SSHConfig{}, "/xdg", filepath.Join("/xdg", stateDirName)},
+		{"default", SSHConfig{}, "", filepath.Join(home, ".local", "state", stateDirName)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_STATE_HOME", tt.xdgStateHome)
+			got, err := sshStateDir(tt.config)
+			if err != nil {
+				t.Fatalf("sshStateDir() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("sshStateDir() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
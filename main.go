@@ -34,12 +34,24 @@ func main() {
 	if err := InitMQTT(&config.MQTT); err != nil {
 		logger.Fatal("Failed to connect to MQTT:", err)
 	}
-	defer DisconnectMQTT()
-
-	// Send discovery messages and start command execution
-	for _, cmd := range config.Commands {
-		SendDiscoveryMessage(cmd, config.MQTT.ClientID)
-		go ExecuteCommandPeriodically(cmd, config.MQTT.ClientID)
+	defer DisconnectMQTT(config.MQTT.ClientID)
+
+	// Send discovery messages, listen for commands and start command execution
+	configureInstanceDevice(config.Commands)
+	delays := startDelays(config.Commands, config.Defaults.Spread)
+	for i, cmd := range config.Commands {
+		for _, entity := range entities(cmd) {
+			SendDiscoveryMessage(entity, config.MQTT.ClientID)
+		}
+		if hasResultSensor(cmd) {
+			SendDiscoveryMessage(resultSensor(cmd), config.MQTT.ClientID)
+		}
+		if hasCommandTopic(cmd) {
+			SubscribeCommandTopic(cmd, config.MQTT.ClientID)
+		}
+		if stateCommand(cmd) != "" {
+			go ExecuteCommandPeriodically(cmd, config.MQTT.ClientID, delays[i])
+		}
 	}
 
 	// Wait for interrupt signal
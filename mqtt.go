@@ -1,21 +1,67 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 var mqttClient mqtt.Client
 
+// defaultMaxReconnectInterval caps the backoff between MQTT connection attempts
+const defaultMaxReconnectInterval = 2 * time.Minute
+
+// mqttSubscription is a topic subscription restored on every connect
+type mqttSubscription struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+var (
+	subscriptionsMu sync.Mutex
+	subscriptions   = make(map[string]mqttSubscription)
+)
+
+// Payloads published to the availability topic
+const (
+	availabilityOnline  = "online"
+	availabilityOffline = "offline"
+)
+
 // InitMQTT connects to MQTT broker
 func InitMQTT(config *MQTTConfig) error {
+	configureTopics(config)
+
+	broker := brokerURL(config)
+
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", config.Broker, config.Port))
+	opts.AddBroker(broker)
 	opts.SetClientID(config.ClientID)
 
+	if usesTLS(broker) {
+		tlsConfig, err := newTLSConfig(config)
+		if err != nil {
+			return err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	if strings.HasPrefix(broker, "ws") {
+		headers := make(http.Header)
+		for name, value := range config.WebSocketHeaders {
+			headers.Set(name, value)
+		}
+		opts.SetHTTPHeaders(headers)
+		opts.SetWebsocketOptions(&mqtt.WebsocketOptions{Proxy: http.ProxyFromEnvironment})
+	}
+
 	if config.Username != "" {
 		opts.SetUsername(config.Username)
 	}
@@ -23,104 +69,249 @@ func InitMQTT(config *MQTTConfig) error {
 		opts.SetPassword(config.Password)
 	}
 
+	// The broker marks every entity unavailable if we disappear without disconnecting
+	opts.SetWill(availabilityTopic(config.ClientID), availabilityOffline, 1, true)
+
 	opts.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
 		logger.Debugf("Received message: %s from topic: %s", msg.Payload(), msg.Topic())
 	})
 
+	maxReconnectInterval := mqttMaxReconnectInterval(config)
+
+	// Paho handles reconnecting after a dropped connection; the initial
+	// connect is retried below so failures can be logged with their cause
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(maxReconnectInterval)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		onMQTTConnect(client, config.ClientID)
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		logger.Warnf("Lost connection to MQTT broker: %v", err)
+	})
+	opts.SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+		logger.Infof("Reconnecting to MQTT broker %s...", broker)
+	})
+
+	// Subscribe to Home Assistant's status so discovery can be replayed when it restarts
+	subscribeMQTT(homeAssistantStatusTopic(), 1, func(_ mqtt.Client, msg mqtt.Message) {
+		if string(msg.Payload()) != "online" {
+			logger.Infof("Home Assistant status: %s", msg.Payload())
+			return
+		}
+		logger.Info("Home Assistant is online, re-sending discovery messages")
+		// Publishing from inside a message handler can deadlock the client
+		go replayDiscovery()
+	})
+
+	offlineBuffer = NewOfflineBuffer(config.OfflineBuffer)
+	logger.Debugf("Offline buffer: %s", offlineBuffer)
+
 	mqttClient = mqtt.NewClient(opts)
 
-	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		logger.Infof("Connecting to MQTT broker %s (attempt %d)", broker, attempt)
+		token := mqttClient.Connect()
+		if token.Wait() && token.Error() == nil {
+			break
+		}
+
+		logger.Warnf("Failed to connect to MQTT broker %s: %v, retrying in %s", broker, token.Error(), delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxReconnectInterval {
+			delay = maxReconnectInterval
+		}
 	}
 
-	logger.Info("Connected to MQTT broker")
 	return nil
 }
 
-// DisconnectMQTT disconnects from MQTT broker
-func DisconnectMQTT() {
-	if mqttClient != nil && mqttClient.IsConnected() {
-		mqttClient.Disconnect(250)
-		logger.Info("Disconnected from MQTT broker")
+// mqttMaxReconnectInterval returns the cap on the delay between connection attempts
+func mqttMaxReconnectInterval(config *MQTTConfig) time.Duration {
+	if config.MaxReconnectInterval == "" {
+		return defaultMaxReconnectInterval
+	}
+
+	interval, err := time.ParseDuration(config.MaxReconnectInterval)
+	if err != nil || interval <= 0 {
+		logger.Errorf("Invalid max_reconnect_interval %q, using %s", config.MaxReconnectInterval, defaultMaxReconnectInterval)
+		return defaultMaxReconnectInterval
 	}
+	return interval
 }
 
-// SendDiscoveryMessage sends Home Assistant discovery message
-func SendDiscoveryMessage(cmd CommandConfig, clientID string) {
-	deviceID := clientID
-	sensorID := fmt.Sprintf("%s_%s", deviceID, sanitizeName(cmd.Name))
+// subscribeMQTT registers a subscription that is (re)established on every
+// connect, and subscribes immediately if already connected
+func subscribeMQTT(topic string, qos byte, handler mqtt.MessageHandler) {
+	subscriptionsMu.Lock()
+	subscriptions[topic] = mqttSubscription{qos: qos, handler: handler}
+	subscriptionsMu.Unlock()
 
-	discovery := HomeAssistantDiscovery{
-		Name:       cmd.Name,
-		StateTopic: fmt.Sprintf("homeassistant/sensor/%s/state", sensorID),
-		UniqueID:   sensorID,
-		Device: Device{
-			Identifiers:  []string{deviceID},
-			Name:         "Command Sensors",
-			Model:        "HA Command to MQTT",
-			Manufacturer: "Custom",
-		},
+	if mqttClient != nil && mqttClient.IsConnectionOpen() {
+		if token := mqttClient.Subscribe(topic, qos, handler); token.Wait() && token.Error() != nil {
+			logger.Errorf("Failed to subscribe to %s: %v", topic, token.Error())
+		}
 	}
+}
 
-	if cmd.DeviceClass != "" {
-		discovery.DeviceClass = cmd.DeviceClass
-	}
-	if cmd.Unit != "" {
-		discovery.UnitOfMeasurement = cmd.Unit
+// onMQTTConnect restores subscriptions and availability on every connect and,
+// on every connect after the first, replays discovery and states in case the
+// broker lost them while we were away
+func onMQTTConnect(client mqtt.Client, clientID string) {
+	logger.Info("Connected to MQTT broker")
+
+	subscriptionsMu.Lock()
+	for topic, subscription := range subscriptions {
+		if token := client.Subscribe(topic, subscription.qos, subscription.handler); token.Wait() && token.Error() != nil {
+			logger.Errorf("Failed to subscribe to %s: %v", topic, token.Error())
+		} else {
+			logger.Debugf("Subscribed to %s", topic)
+		}
 	}
-	if cmd.Icon != "" {
-		discovery.Icon = cmd.Icon
+	subscriptionsMu.Unlock()
+
+	publishAvailability(clientID, availabilityOnline)
+
+	// Deliver results produced while disconnected before anything newer
+	offlineBuffer.Flush()
+
+	announcedMu.Lock()
+	reconnected := connectedOnce
+	connectedOnce = true
+	announcedMu.Unlock()
+
+	if reconnected {
+		logger.Info("Reconnected to MQTT broker, re-sending discovery messages")
+		replayDiscovery()
 	}
-	if cmd.ForceUpdate {
-		discovery.ForceUpdate = cmd.ForceUpdate
+}
+
+// brokerURL builds the broker URL from the configured host, port, transport
+// and TLS setting. A broker that already includes a scheme is used as-is.
+func brokerURL(config *MQTTConfig) string {
+	if strings.Contains(config.Broker, "://") {
+		return config.Broker
 	}
-	if cmd.StateClass != "" {
-		discovery.StateClass = cmd.StateClass
+
+	websockets := isWebSocketTransport(config.Transport)
+
+	scheme := "tcp"
+	port := config.Port
+	switch {
+	case websockets && config.TLS:
+		scheme = "wss"
+	case websockets:
+		scheme = "ws"
+	case config.TLS:
+		scheme = "ssl"
 	}
-	if cmd.EntityCategory != "" {
-		discovery.EntityCategory = cmd.EntityCategory
+	if port == 0 {
+		port = defaultBrokerPort(config.Transport, config.TLS)
 	}
-	if cmd.ExpireAfter > 0 {
-		discovery.ExpireAfter = cmd.ExpireAfter
+
+	if !websockets {
+		return fmt.Sprintf("%s://%s:%d", scheme, config.Broker, port)
 	}
 
-	payload, err := json.Marshal(discovery)
-	if err != nil {
-		logger.Errorf("Failed to marshal discovery message for %s: %v", cmd.Name, err)
-		return
+	path := config.WebSocketPath
+	if path == "" {
+		path = "/mqtt"
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
 	}
+	return fmt.Sprintf("%s://%s:%d%s", scheme, config.Broker, port, path)
+}
 
-	topic := fmt.Sprintf("homeassistant/sensor/%s/config", sensorID)
-	token := mqttClient.Publish(topic, 0, true, payload)
-	token.Wait()
+// isWebSocketTransport reports whether transport selects MQTT over WebSockets
+func isWebSocketTransport(transport string) bool {
+	return strings.EqualFold(transport, "websockets") || strings.EqualFold(transport, "websocket")
+}
 
-	logger.Infof("Sent discovery message for %s", cmd.Name)
+// defaultBrokerPort returns the usual port for a transport: 1883/8883 for
+// plain MQTT and 80/443 for WebSockets behind a web server
+func defaultBrokerPort(transport string, useTLS bool) int {
+	switch {
+	case isWebSocketTransport(transport) && useTLS:
+		return 443
+	case isWebSocketTransport(transport):
+		return 80
+	case useTLS:
+		return 8883
+	}
+	return 1883
 }
 
-// PublishResult publishes command result to MQTT
-func PublishResult(cmd CommandConfig, result string, clientID string) {
-	deviceID := clientID
-	sensorID := fmt.Sprintf("%s_%s", deviceID, sanitizeName(cmd.Name))
-	topic := fmt.Sprintf("homeassistant/sensor/%s/state", sensorID)
+// usesTLS reports whether a broker URL's scheme is encrypted
+func usesTLS(broker string) bool {
+	scheme, _, _ := strings.Cut(broker, "://")
+	switch strings.ToLower(scheme) {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
 
-	token := mqttClient.Publish(topic, 0, false, result)
-	token.Wait()
+// newTLSConfig builds the TLS configuration for the broker connection,
+// including a client certificate when mutual TLS is configured
+func newTLSConfig(config *MQTTConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.TLSServerName,
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+	}
 
-	logger.Infof("Published result for %s: %s", cmd.Name, result)
-}
+	if config.TLSInsecureSkipVerify {
+		logger.Warn("MQTT broker certificate verification is disabled")
+	}
 
-// sanitizeName replaces spaces and special characters with underscores
-func sanitizeName(name string) string {
-	// Replace spaces and special characters with underscores
-	result := strings.ToLower(name)
-	result = strings.ReplaceAll(result, " ", "_")
-	result = strings.ReplaceAll(result, "-", "_")
-	// Remove any characters that aren't alphanumeric or underscore
-	var sanitized strings.Builder
-	for _, r := range result {
-		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
-			sanitized.WriteRune(r)
+	if config.CACert != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
 		}
+
+		caBytes, err := os.ReadFile(config.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MQTT CA certificate %s: %v", config.CACert, err)
+		}
+		if !rootCAs.AppendCertsFromPEM(caBytes) {
+			return nil, fmt.Errorf("no certificates found in MQTT CA certificate %s", config.CACert)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if config.ClientCert == "" || config.ClientKey == "" {
+			return nil, fmt.Errorf("both client_cert and client_key are required for MQTT mutual TLS")
+		}
+
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MQTT client certificate %s: %v", config.ClientCert, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// DisconnectMQTT disconnects from MQTT broker
+func DisconnectMQTT(clientID string) {
+	if mqttClient != nil && mqttClient.IsConnected() {
+		publishAvailability(clientID, availabilityOffline)
+		mqttClient.Disconnect(250)
+		logger.Info("Disconnected from MQTT broker")
+	}
+}
+
+// publishAvailability publishes a retained online/offline availability message
+func publishAvailability(clientID, state string) {
+	token := mqttClient.Publish(availabilityTopic(clientID), 1, true, state)
+	if token.Wait() && token.Error() != nil {
+		logger.Errorf("Failed to publish availability %s: %v", state, token.Error())
+		return
 	}
-	return sanitized.String()
+	logger.Debugf("Published availability: %s", state)
 }
\ No newline at end of file
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	// Timezones must resolve on minimal images without /usr/share/zoneinfo
+	_ "time/tzdata"
+)
+
+// cronSchedule is a parsed cron expression. Each field is a bitset of the
+// values it matches.
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+
+	// Like cron, when both day fields are restricted a day matching either is used
+	domRestricted, dowRestricted bool
+}
+
+// cronField describes the range and names of one cron field
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronSecond = cronField{name: "second", min: 0, max: 59}
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is accepted for Sunday and folded onto 0
+	cronDow = cronField{name: "day of week", min: 0, max: 7, names: weekdayNames}
+)
+
+// weekdayNames maps day names to time.Weekday numbers
+var weekdayNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// cronMacros are the shorthand schedules cron understands
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+// parseCron parses a cron expression with five fields (minute hour
+// day-of-month month day-of-week), or six with a leading seconds field
+func parseCron(expression string) (*cronSchedule, error) {
+	expression = strings.TrimSpace(expression)
+	if macro, exists := cronMacros[strings.ToLower(expression)]; exists {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("expected 5 or 6 fields, got %d", len(fields))
+	}
+
+	var schedule cronSchedule
+	var err error
+	for i, target := range []struct {
+		bits  *uint64
+		field cronField
+	}{
+		{&schedule.second, cronSecond},
+		{&schedule.minute, cronMinute},
+		{&schedule.hour, cronHour},
+		{&schedule.dom, cronDom},
+		{&schedule.month, cronMonth},
+		{&schedule.dow, cronDow},
+	} {
+		if *target.bits, err = parseCronField(fields[i], target.field); err != nil {
+			return nil, err
+		}
+	}
+
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow = schedule.dow&^(1<<7) | 1
+	}
+	schedule.domRestricted = !isCronDayWildcard(fields[3])
+	schedule.dowRestricted = !isCronDayWildcard(fields[5])
+
+	return &schedule, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps
+func parseCronField(value string, field cronField) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(value, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepPart, field.name)
+			}
+		}
+
+		low, high := field.min, field.max
+		if !isCronWildcard(rangePart) {
+			lowPart, highPart, isRange := strings.Cut(rangePart, "-")
+
+			var err error
+			if low, err = cronValue(lowPart, field); err != nil {
+				return 0, err
+			}
+			high = low
+			if isRange {
+				if high, err = cronValue(highPart, field); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// "5/15" means from 5 to the end in steps of 15
+				high = field.max
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range %q in %s field", rangePart, field.name)
+			}
+		}
+
+		for v := low; v <= high; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// cronValue parses a single number or name of a field
+func cronValue(value string, field cronField) (int, error) {
+	if number, exists := field.names[strings.ToLower(value)]; exists {
+		return number, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < field.min || number > field.max {
+		return 0, fmt.Errorf("invalid %s %q", field.name, value)
+	}
+	return number, nil
+}
+
+func isCronWildcard(value string) bool {
+	return value == "*" || value == "?"
+}
+
+// isCronDayWildcard reports whether a day field leaves the days unrestricted
+// when choosing between OR and AND. As in cron, any field starting with *
+// counts, so "*/2" still has to agree with the other day field.
+func isCronDayWildcard(value string) bool {
+	return strings.HasPrefix(value, "*") || value == "?"
+}
+
+// Next returns the first time after t the schedule fires, in t's location,
+// or the zero time if it never does (e.g. "0 0 30 2 *")
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	location := t.Location()
+	t = t.Truncate(time.Second).Add(time.Second)
+	limit := t.Year() + 5
+
+	for t.Year() <= limit {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if s.second&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
+
+// activeWindow limits when a command runs to a time of day and/or days of the week
+type activeWindow struct {
+	start, end int    // minutes since midnight, end exclusive; equal means all day
+	days       uint64 // bitset of time.Weekday, 0 means every day
+}
+
+// parseActiveWindow parses active_hours ("08:00-22:00", may wrap past
+// midnight) and active_days ("mon-fri", "sat,sun", "weekdays", "weekends")
+func parseActiveWindow(hours, days string) (activeWindow, error) {
+	var window activeWindow
+
+	if hours != "" {
+		startPart, endPart, ok := strings.Cut(hours, "-")
+		if !ok {
+			return window, fmt.Errorf("invalid active_hours %q, expected HH:MM-HH:MM", hours)
+		}
+		var err error
+		if window.start, err = parseClock(startPart); err != nil {
+			return window, fmt.Errorf("invalid active_hours %q: %v", hours, err)
+		}
+		if window.end, err = parseClock(endPart); err != nil {
+			return window, fmt.Errorf("invalid active_hours %q: %v", hours, err)
+		}
+	}
+
+	if days != "" {
+		switch strings.ToLower(strings.TrimSpace(days)) {
+		case "weekdays":
+			days = "mon-fri"
+		case "weekends":
+			days = "sat,sun"
+		}
+		set, err := parseCronField(strings.ReplaceAll(days, " ", ""), cronDow)
+		if err != nil {
+			return window, fmt.Errorf("invalid active_days %q: %v", days, err)
+		}
+		if set&(1<<7) != 0 {
+			set = set&^(1<<7) | 1
+		}
+		window.days = set
+	}
+
+	return window, nil
+}
+
+// parseClock parses HH:MM into minutes since midnight. 24:00 is the end of the day.
+func parseClock(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "24:00" {
+		return 24 * 60, nil
+	}
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// contains reports whether t falls inside the window. Days are checked
+// against t itself, so a window past midnight on "fri" ends at midnight.
+func (w activeWindow) contains(t time.Time) bool {
+	if w.days != 0 && w.days&(1<<uint(t.Weekday())) == 0 {
+		return false
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	switch {
+	case w.start == w.end:
+		return true
+	case w.start < w.end:
+		return minute >= w.start && minute < w.end
+	default:
+		return minute >= w.start || minute < w.end
+	}
+}
+
+// String describes the window for logging
+func (w activeWindow) String() string {
+	var parts []string
+	if w.start != w.end {
+		parts = append(parts, fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60))
+	}
+	if w.days != 0 {
+		var days []string
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if w.days&(1<<uint(day)) != 0 {
+				days = append(days, day.String()[:3])
+			}
+		}
+		parts = append(parts, strings.Join(days, ","))
+	}
+	if len(parts) == 0 {
+		return "always"
+	}
+	return strings.Join(parts, " ")
+}
+
+// commandLocation returns the timezone a command's schedule and window are evaluated in
+func commandLocation(cmd CommandConfig) (*time.Location, error) {
+	if cmd.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(cmd.Timezone)
+}
+
+// validateSchedule checks a command's schedule, timezone and active window
+func validateSchedule(cmd CommandConfig) error {
+	if cmd.Schedule != "" {
+		schedule, err := parseCron(cmd.Schedule)
+		if err != nil {
+			return fmt.Errorf("command %s: invalid schedule %q: %v", cmd.Name, cmd.Schedule, err)
+		}
+		if schedule.Next(time.Now()).IsZero() {
+			return fmt.Errorf("command %s: schedule %q never fires", cmd.Name, cmd.Schedule)
+		}
+		if cmd.InitialDelay != "" {
+			return fmt.Errorf("command %s: initial_delay only applies to commands using frequency, not schedule", cmd.Name)
+		}
+	}
+	if _, err := commandLocation(cmd); err != nil {
+		return fmt.Errorf("command %s: invalid timezone: %v", cmd.Name, err)
+	}
+	if _, err := parseActiveWindow(cmd.ActiveHours, cmd.ActiveDays); err != nil {
+		return fmt.Errorf("command %s: %v", cmd.Name, err)
+	}
+	for field, value := range map[string]string{"initial_delay": cmd.InitialDelay, "jitter": cmd.Jitter} {
+		if value == "" {
+			continue
+		}
+		if duration, err := time.ParseDuration(value); err != nil || duration < 0 {
+			return fmt.Errorf("command %s: invalid %s %q", cmd.Name, field, value)
+		}
+	}
+	return nil
+}
+
+// optionalDuration parses a duration that has already been validated, treating "" as zero
+func optionalDuration(value string) time.Duration {
+	duration, _ := time.ParseDuration(value)
+	return duration
+}
+
+// commandFrequency returns how often a command runs when it has no schedule
+func commandFrequency(cmd CommandConfig) (time.Duration, error) {
+	frequency, err := time.ParseDuration(cmd.Frequency)
+	if err != nil || frequency <= 0 {
+		return 60 * time.Second, fmt.Errorf("invalid frequency %q", cmd.Frequency) // Default to 60 seconds
+	}
+	return frequency, nil
+}
+
+// startDelays returns how long each command waits before its first run: its
+// initial_delay plus, with spread, an offset that staggers the commands
+// sharing a frequency evenly across it, so they don't all run on the same tick
+func startDelays(commands []CommandConfig, spread bool) []time.Duration {
+	delays := make([]time.Duration, len(commands))
+	groups := make(map[time.Duration][]int)
+
+	for i, cmd := range commands {
+		delays[i] = optionalDuration(cmd.InitialDelay)
+
+		// Only commands running on a fixed frequency start straight away
+		if cmd.Schedule != "" || stateCommand(cmd) == "" {
+			continue
+		}
+		frequency, _ := commandFrequency(cmd)
+		groups[frequency] = append(groups[frequency], i)
+	}
+
+	if spread {
+		for frequency, members := range groups {
+			for position, i := range members {
+				delays[i] += frequency * time.Duration(position) / time.Duration(len(members))
+			}
+		}
+	}
+
+	return delays
+}
+
+// jitterDelay returns a random delay of up to the command's jitter
+func jitterDelay(cmd CommandConfig) time.Duration {
+	jitter := optionalDuration(cmd.Jitter)
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
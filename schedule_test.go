@@ -0,0 +1,191 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expression string
+		wantErr    bool
+	}{
+		{"* * * * *", false},
+		{"*/5 * * * *", false},
+		{"5/15 * * * *", false},
+		{"0 9 * * 1-5", false},
+		{"0 9 * * mon-fri", false},
+		{"0 0 1 jan,jul *", false},
+		{"0 9 * * 7", false},
+		{"30 */2 * * * *", false},
+		{"@daily", false},
+		{"@Hourly", false},
+		{"*/0 * * * *", true},
+		{"*/-1 * * * *", true},
+		{"*/x * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"5-1 * * * *", true},
+		{"* * * *", true},
+		{"* * * * * * *", true},
+		{"@reboot", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			_, err := parseCron(tt.expression)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseCron(%q) error = %v, wantErr %v", tt.expression, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(year int, month time.Month, day, hour, minute, second int) time.Time {
+		return time.Date(year, month, day, hour, minute, second, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		from       time.Time
+		want       time.Time
+	}{
+		{"every minute", "* * * * *", at(2024, 1, 1, 10, 7, 30), at(2024, 1, 1, 10, 8, 0)},
+		{"strictly after", "0 0 * * *", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 2, 0, 0, 0)},
+		{"step", "*/15 * * * *", at(2024, 1, 1, 10, 7, 0), at(2024, 1, 1, 10, 15, 0)},
+		{"step from offset", "5/15 * * * *", at(2024, 1, 1, 10, 21, 0), at(2024, 1, 1, 10, 35, 0)},
+		{"step from offset wraps hour", "5/15 * * * *", at(2024, 1, 1, 10, 50, 0), at(2024, 1, 1, 11, 5, 0)},
+		{"range with step", "0 8-18/4 * * *", at(2024, 1, 1, 13, 0, 0), at(2024, 1, 1, 16, 0, 0)},
+		{"list", "0 6,18 * * *", at(2024, 1, 1, 7, 0, 0), at(2024, 1, 1, 18, 0, 0)},
+		{"seconds field", "30 * * * * *", at(2024, 1, 1, 10, 0, 10), at(2024, 1, 1, 10, 0, 30)},
+		{"sunday as 0", "0 9 * * 0", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 7, 9, 0, 0)},
+		{"sunday as 7", "0 9 * * 7", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 7, 9, 0, 0)},
+		{"sunday by name", "0 9 * * sun", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 7, 9, 0, 0)},
+		{"weekdays skip weekend", "0 9 * * mon-fri", at(2024, 1, 5, 10, 0, 0), at(2024, 1, 8, 9, 0, 0)},
+		{"day of month or day of week", "0 0 13 * 5", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 5, 0, 0, 0)},
+		{"day of month step is still a wildcard", "0 0 */2 * 1", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 15, 0, 0, 0)},
+		{"day of week step is still a wildcard", "0 0 13 * */2", at(2024, 1, 14, 0, 0, 0), at(2024, 2, 13, 0, 0, 0)},
+		{"day of month only", "0 0 13 * *", at(2024, 1, 1, 0, 0, 0), at(2024, 1, 13, 0, 0, 0)},
+		{"month name", "0 0 1 jan *", at(2024, 2, 1, 0, 0, 0), at(2025, 1, 1, 0, 0, 0)},
+		{"31st skips short months", "0 0 31 * *", at(2024, 4, 1, 0, 0, 0), at(2024, 5, 31, 0, 0, 0)},
+		{"leap day", "0 0 29 2 *", at(2024, 3, 1, 0, 0, 0), at(2028, 2, 29, 0, 0, 0)},
+		{"macro", "@hourly", at(2024, 1, 1, 10, 7, 0), at(2024, 1, 1, 11, 0, 0)},
+		{"end of year", "@yearly", at(2024, 12, 31, 23, 59, 59), at(2025, 1, 1, 0, 0, 0)},
+		{"feb 30 never fires", "0 0 30 2 *", at(2024, 1, 1, 0, 0, 0), time.Time{}},
+		{"nov 31 never fires", "0 0 31 11 *", at(2024, 1, 1, 0, 0, 0), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := parseCron(tt.expression)
+			if err != nil {
+				t.Fatalf("parseCron(%q) error = %v", tt.expression, err)
+			}
+			if got := schedule.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) for %q = %s, want %s", tt.from, tt.expression, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNextLocation(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schedule, err := parseCron("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := time.Date(2024, 1, 1, 12, 0, 0, 0, location)
+	want := time.Date(2024, 1, 2, 9, 0, 0, 0, location)
+	if got := schedule.Next(from); !got.Equal(want) || got.Location() != location {
+		t.Errorf("Next(%s) = %s, want %s", from, got, want)
+	}
+}
+
+func TestParseActiveWindow(t *testing.T) {
+	tests := []struct {
+		hours, days string
+		wantErr     bool
+	}{
+		{"08:00-22:00", "", false},
+		{"22:00-06:00", "", false},
+		{"00:00-24:00", "", false},
+		{"", "mon-fri", false},
+		{"", "sat,sun", false},
+		{"", "Weekdays", false},
+		{"", "weekends", false},
+		{"", "fri-sun", true},
+		{"", "7", false},
+		{"08:00", "", true},
+		{"8-22", "", true},
+		{"08:00-25:00", "", true},
+		{"08:60-22:00", "", true},
+		{"", "funday", true},
+		{"", "*/0", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hours+"/"+tt.days, func(t *testing.T) {
+			_, err := parseActiveWindow(tt.hours, tt.days)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseActiveWindow(%q, %q) error = %v, wantErr %v", tt.hours, tt.days, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestActiveWindowContains(t *testing.T) {
+	// 2024-01-06 is a Saturday, 2024-01-07 a Sunday and 2024-01-08 a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name        string
+		hours, days string
+		at          time.Time
+		want        bool
+	}{
+		{"no window", "", "", at(6, 3, 0), true},
+		{"before start", "08:00-22:00", "", at(8, 7, 59), false},
+		{"at start", "08:00-22:00", "", at(8, 8, 0), true},
+		{"before end", "08:00-22:00", "", at(8, 21, 59), true},
+		{"end is exclusive", "08:00-22:00", "", at(8, 22, 0), false},
+		{"overnight late", "22:00-06:00", "", at(8, 23, 0), true},
+		{"overnight early", "22:00-06:00", "", at(8, 5, 59), true},
+		{"overnight end", "22:00-06:00", "", at(8, 6, 0), false},
+		{"overnight midday", "22:00-06:00", "", at(8, 12, 0), false},
+		{"until midnight", "00:00-24:00", "", at(8, 23, 59), true},
+		{"weekday on monday", "", "weekdays", at(8, 12, 0), true},
+		{"weekday on saturday", "", "weekdays", at(6, 12, 0), false},
+		{"weekend on sunday", "", "weekends", at(7, 12, 0), true},
+		{"sunday as 7", "", "7", at(7, 12, 0), true},
+		{"sunday as 7 on monday", "", "7", at(8, 12, 0), false},
+		{"hours and days", "08:00-17:00", "mon-fri", at(8, 9, 0), true},
+		{"hours and wrong day", "08:00-17:00", "mon-fri", at(7, 9, 0), false},
+		{"days checked against the time itself", "22:00-06:00", "fri", at(6, 1, 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, err := parseActiveWindow(tt.hours, tt.days)
+			if err != nil {
+				t.Fatalf("parseActiveWindow(%q, %q) error = %v", tt.hours, tt.days, err)
+			}
+			if got := window.contains(tt.at); got != tt.want {
+				t.Errorf("contains(%s) for %q/%q = %v, want %v", tt.at, tt.hours, tt.days, got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -18,11 +20,10 @@ type SSHConnection struct {
 	config SSHHost
 }
 
-var sshConnections map[string]*SSHConnection
+var sshManager = NewSSHManager()
 
 // InitSSHConnections initializes SSH connections based on configuration
 func InitSSHConnections(config *Config) error {
-	sshConnections = make(map[string]*SSHConnection)
 
 	// Check if SSH configuration exists and has hosts
 	if len(config.SSH.Hosts) == 0 {
@@ -32,15 +33,29 @@ func InitSSHConnections(config *Config) error {
 
 	logger.Infof("Initializing %d SSH connection(s)...", len(config.SSH.Hosts))
 
+	if err := validateJumpHosts(config.SSH.Hosts); err != nil {
+		return err
+	}
+
+	stateDir, err := sshStateDir(config.SSH)
+	if err != nil {
+		return err
+	}
+	sshManager.SetStateDir(stateDir)
+
+	// Every host is registered up front so commands can tell an unreachable
+	// host apart from one that was never configured, and so jump hosts are
+	// known before the hosts behind them connect
+	for _, host := range config.SSH.Hosts {
+		sshManager.Register(host)
+	}
+
 	successCount := 0
 	for _, host := range config.SSH.Hosts {
-		conn, err := createSSHConnection(host)
-		if err != nil {
-			logger.Errorf("Failed to connect to SSH host %s: %v", host.Name, err)
+		if err := sshManager.Connect(host.Name); err != nil {
+			logger.Errorf("Failed to connect to SSH host %s, will keep retrying in the background: %v", host.Name, err)
 			continue // Don't fail completely, just log and continue
 		}
-		sshConnections[host.Name] = conn
-		logger.Infof("Connected to SSH host: %s", host.Name)
 		successCount++
 	}
 
@@ -48,13 +63,13 @@ func InitSSHConnections(config *Config) error {
 	return nil
 }
 
-func createSSHConnection(hostConfig SSHHost) (*SSHConnection, error) {
+func createSSHConnection(hostConfig SSHHost, manager *SSHManager) (*SSHConnection, error) {
 	var authMethods []ssh.AuthMethod
 
 	// Try key-based authentication first
 	if hostConfig.KeyPath != "" {
 		logger.Debugf("Loading specified SSH key for host %s: %s", hostConfig.Name, hostConfig.KeyPath)
-		key, err := loadSSHKey(hostConfig.KeyPath)
+		key, err := loadHostSSHKey(hostConfig)
 		if err != nil {
 			logger.Errorf("Failed to load specified SSH key for host %s from %s: %v", hostConfig.Name, hostConfig.KeyPath, err)
 		} else {
@@ -95,7 +110,7 @@ func createSSHConnection(hostConfig SSHHost) (*SSHConnection, error) {
 				keysFound := false
 				for _, keyPath := range defaultKeys {
 					logger.Debugf("Trying SSH key: %s", keyPath)
-					if key, err := loadSSHKey(keyPath); err == nil {
+					if key, err := loadSSHKey(keyPath, nil); err == nil {
 						authMethods = append(authMethods, ssh.PublicKeys(key))
 						logger.Debugf("Successfully loaded SSH key: %s", keyPath)
 						keysFound = true
@@ -130,15 +145,22 @@ func createSSHConnection(hostConfig SSHHost) (*SSHConnection, error) {
 		port = hostConfig.Port
 	}
 
+	addr := fmt.Sprintf("%s:%d", hostConfig.Host, port)
+
+	hostKeyCheck, hostKeyAlgorithms, err := hostKeyCallback(hostConfig, addr, manager.StateDir())
+	if err != nil {
+		return nil, err
+	}
+
 	sshConfig := &ssh.ClientConfig{
-		User:            hostConfig.User,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // In production, use proper host key verification
-		Timeout:         timeout,
+		User:              hostConfig.User,
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCheck,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           timeout,
 	}
 
-	addr := fmt.Sprintf("%s:%d", hostConfig.Host, port)
-	client, err := ssh.Dial("tcp", addr, sshConfig)
+	client, err := dialSSH(hostConfig, addr, sshConfig, manager)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
 	}
@@ -149,7 +171,129 @@ func createSSHConnection(hostConfig SSHHost) (*SSHConnection, error) {
 	}, nil
 }
 
-func loadSSHKey(keyPath string) (ssh.Signer, error) {
+// dialSSH connects to addr directly, or tunnels through the host's jump host
+// when one is configured. The jump host's connection comes from the manager
+// doing the dial, so every host behind the same bastion shares a single
+// connection to it.
+func dialSSH(hostConfig SSHHost, addr string, sshConfig *ssh.ClientConfig, manager *SSHManager) (*ssh.Client, error) {
+	if hostConfig.JumpHost == "" {
+		return ssh.Dial("tcp", addr, sshConfig)
+	}
+
+	bastion, err := manager.Connection(hostConfig.JumpHost)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %v", hostConfig.JumpHost, err)
+	}
+
+	logger.Debugf("Connecting to SSH host %s via jump host %s", hostConfig.Name, hostConfig.JumpHost)
+	conn, err := dialViaJumpHost(bastion.client, addr, sshConfig.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s via jump host %s: %v", addr, hostConfig.JumpHost, err)
+	}
+
+	// Tunneled connections don't support deadlines, so enforce the handshake
+	// timeout by closing the connection if it takes too long. As with
+	// ssh.Dial, a zero timeout means no limit.
+	if sshConfig.Timeout > 0 {
+		timer := time.AfterFunc(sshConfig.Timeout, func() { conn.Close() })
+		defer timer.Stop()
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+// jumpDialer opens connections through a jump host; *ssh.Client satisfies it
+type jumpDialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// dialViaJumpHost opens a tunneled connection to addr through a bastion.
+// The channel open can't be cancelled, so when it outlasts the timeout the
+// dial is abandoned and a connection that arrives late is closed.
+func dialViaJumpHost(bastion jumpDialer, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return bastion.Dial("tcp", addr)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan dialResult, 1)
+	go func() {
+		conn, err := bastion.Dial("tcp", addr)
+		done <- dialResult{conn, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		return result.conn, result.err
+	case <-timer.C:
+		go func() {
+			if result := <-done; result.conn != nil {
+				result.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("timed out after %s", timeout)
+	}
+}
+
+// validateJumpHosts checks that every jump_host refers to a configured host
+// and that no chain of jump hosts loops back on itself
+func validateJumpHosts(hosts []SSHHost) error {
+	byName := make(map[string]SSHHost, len(hosts))
+	for _, host := range hosts {
+		byName[host.Name] = host
+	}
+
+	for _, host := range hosts {
+		seen := map[string]bool{host.Name: true}
+		for current := host; current.JumpHost != ""; {
+			next, exists := byName[current.JumpHost]
+			if !exists {
+				return fmt.Errorf("SSH host %s uses unknown jump host %s", current.Name, current.JumpHost)
+			}
+			if seen[next.Name] {
+				return fmt.Errorf("SSH host %s has a jump host loop through %s", host.Name, next.Name)
+			}
+			seen[next.Name] = true
+			current = next
+		}
+	}
+
+	return nil
+}
+
+// loadHostSSHKey loads the configured key for a host, decrypting it with the
+// configured passphrase and wrapping it in the host's certificate if one is set
+func loadHostSSHKey(hostConfig SSHHost) (ssh.Signer, error) {
+	passphrase, err := keyPassphrase(hostConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := loadSSHKey(hostConfig.KeyPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	if hostConfig.CertificatePath == "" {
+		return signer, nil
+	}
+
+	logger.Debugf("Loading SSH certificate for host %s: %s", hostConfig.Name, hostConfig.CertificatePath)
+	return loadSSHCertificate(hostConfig.CertificatePath, signer)
+}
+
+func loadSSHKey(keyPath string, passphrase []byte) (ssh.Signer, error) {
 	// Check if the key file exists first
 	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("SSH key file does not exist: %s", keyPath)
@@ -160,31 +304,91 @@ func loadSSHKey(keyPath string) (ssh.Signer, error) {
 		return nil, fmt.Errorf("failed to read SSH key file %s: %v", keyPath, err)
 	}
 
-	// Try to parse as encrypted key first
 	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err == nil {
+		return signer, nil
+	}
+
+	var missingErr *ssh.PassphraseMissingError
+	if !errors.As(err, &missingErr) {
+		return nil, fmt.Errorf("failed to parse SSH private key %s: %v", keyPath, err)
+	}
+
+	// The key is encrypted, so a passphrase is required
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("SSH private key %s is encrypted, set key_passphrase or key_passphrase_file", keyPath)
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(keyBytes, passphrase)
 	if err != nil {
-		// If that fails, it might be encrypted - for now we don't support passphrase
-		return nil, fmt.Errorf("failed to parse SSH private key %s (encrypted keys with passphrases not supported): %v", keyPath, err)
+		return nil, fmt.Errorf("failed to decrypt SSH private key %s: %v", keyPath, err)
 	}
 
 	return signer, nil
 }
 
+// keyPassphrase returns the passphrase for a host's key, read from
+// key_passphrase_file if set, otherwise key_passphrase
+func keyPassphrase(hostConfig SSHHost) ([]byte, error) {
+	if hostConfig.KeyPassphraseFile == "" {
+		return []byte(hostConfig.KeyPassphrase), nil
+	}
+
+	data, err := os.ReadFile(hostConfig.KeyPassphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key passphrase file %s: %v", hostConfig.KeyPassphraseFile, err)
+	}
+
+	// Strip the trailing newline editors and `echo` leave behind
+	return bytes.TrimRight(data, "\r\n"), nil
+}
+
+// loadSSHCertificate wraps a signer with the OpenSSH user certificate at certPath
+func loadSSHCertificate(certPath string, signer ssh.Signer) (ssh.Signer, error) {
+	certBytes, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH certificate %s: %v", certPath, err)
+	}
+
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH certificate %s: %v", certPath, err)
+	}
+
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is a public key, not an SSH certificate", certPath)
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("SSH certificate %s is not a user certificate", certPath)
+	}
+
+	if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().After(time.Unix(int64(cert.ValidBefore), 0)) {
+		logger.Warnf("SSH certificate %s expired at %s", certPath, time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("SSH certificate %s does not match its private key: %v", certPath, err)
+	}
+
+	return certSigner, nil
+}
+
 // CloseSSHConnections closes all SSH connections
 func CloseSSHConnections() {
-	for name, conn := range sshConnections {
-		if conn != nil && conn.client != nil {
-			conn.client.Close()
-			logger.Infof("Closed SSH connection to: %s", name)
-		}
-	}
+	sshManager.Close()
 }
 
-// ExecuteSSHCommand executes a command on an SSH connection
-func ExecuteSSHCommand(conn *SSHConnection, command string) (string, error) {
+// ExecuteSSHCommand executes a command on an SSH connection. If ctx is done
+// before the command finishes, the remote process is signalled and the session
+// closed, and ctx.Err() is returned. A non-zero exit wraps *ssh.ExitError.
+// Stdout and stderr are returned separately.
+func ExecuteSSHCommand(ctx context.Context, conn *SSHConnection, command string) (string, string, error) {
 	session, err := conn.client.NewSession()
 	if err != nil {
-		return "", fmt.Errorf("failed to create SSH session: %v", err)
+		return "", "", fmt.Errorf("failed to create SSH session: %v", err)
 	}
 	defer session.Close()
 
@@ -193,12 +397,32 @@ func ExecuteSSHCommand(conn *SSHConnection, command string) (string, error) {
 	session.Stdout = &stdout
 	session.Stderr = &stderr
 
-	err = session.Run(command)
+	if err := session.Start(command); err != nil {
+		return "", "", fmt.Errorf("failed to start command: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Not every server honours signals, so closing the session is what actually unblocks us
+		if sigErr := session.Signal(ssh.SIGKILL); sigErr != nil {
+			logger.Debugf("Failed to signal remote command on %s: %v", conn.config.Name, sigErr)
+		}
+		session.Close()
+		return "", "", ctx.Err()
+	}
+
 	if err != nil {
-		return "", fmt.Errorf("command failed: %v, stderr: %s", err, stderr.String())
+		// Output is still returned, since a non-zero exit can be meaningful
+		return stdout.String(), stderr.String(), fmt.Errorf("command failed: %w, stderr: %s", err, stderr.String())
 	}
 
-	return stdout.String(), nil
+	return stdout.String(), stderr.String(), nil
 }
 
 // IsSSHConnectionAlive tests if an SSH connection is still alive
@@ -214,24 +438,7 @@ func IsSSHConnectionAlive(conn *SSHConnection) bool {
 
 // GetSSHConnection returns the SSH connection for a given host name
 func GetSSHConnection(hostName string) (*SSHConnection, bool) {
-	conn, exists := sshConnections[hostName]
-	return conn, exists
-}
-
-// ReconnectSSH attempts to reconnect to an SSH host
-func ReconnectSSH(hostName string) error {
-	conn, exists := sshConnections[hostName]
-	if !exists {
-		return fmt.Errorf("SSH host %s not found", hostName)
-	}
-
-	newConn, err := createSSHConnection(conn.config)
-	if err != nil {
-		return err
-	}
-
-	sshConnections[hostName] = newConn
-	return nil
+	return sshManager.Get(hostName)
 }
 
 // trySSHAgent attempts to connect to SSH agent and return authentication method
@@ -271,4 +478,4 @@ func trySSHAgent(hostName string) ssh.AuthMethod {
 
 	// Return SSH agent authentication method
 	return ssh.PublicKeysCallback(agentClient.Signers)
-}
\ No newline at end of file
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// SSHConnectionState describes the current state of a managed SSH host
+type SSHConnectionState int
+
+const (
+	SSHStateDisconnected SSHConnectionState = iota
+	SSHStateConnecting
+	SSHStateConnected
+	SSHStateUnreachable
+)
+
+// Backoff bounds for background reconnection attempts
+const (
+	sshRetryInitialDelay = 5 * time.Second
+	sshRetryMaxDelay     = 5 * time.Minute
+)
+
+func (s SSHConnectionState) String() string {
+	switch s {
+	case SSHStateConnecting:
+		return "connecting"
+	case SSHStateConnected:
+		return "connected"
+	case SSHStateUnreachable:
+		return "unreachable"
+	default:
+		return "disconnected"
+	}
+}
+
+// SSHHostStatus is a snapshot of a managed host's connection state
+type SSHHostStatus struct {
+	State     SSHConnectionState
+	LastError error
+}
+
+// SSHManager owns the pool of SSH connections. All access to the pool goes
+// through the manager, and concurrent reconnects to the same host are
+// coalesced into a single dial.
+type SSHManager struct {
+	mu    sync.RWMutex
+	hosts map[string]*managedSSHHost
+	dials singleflight.Group
+
+	stateDir string // where host keys learned on first use are recorded
+
+	// Dialing, liveness checks and retry backoff, replaceable in tests
+	dial       func(SSHHost) (*SSHConnection, error)
+	alive      func(*SSHConnection) bool
+	retryDelay func(attempt int) time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	closed   bool // set by Close; guarded by mu
+}
+
+type managedSSHHost struct {
+	config   SSHHost
+	conn     *SSHConnection
+	status   SSHHostStatus
+	retrying bool
+}
+
+// NewSSHManager creates an empty connection manager
+func NewSSHManager() *SSHManager {
+	m := &SSHManager{
+		hosts:      make(map[string]*managedSSHHost),
+		stop:       make(chan struct{}),
+		alive:      IsSSHConnectionAlive,
+		retryDelay: sshRetryDelay,
+	}
+	m.dial = func(config SSHHost) (*SSHConnection, error) {
+		return createSSHConnection(config, m)
+	}
+	return m
+}
+
+// Register adds a host to the pool without connecting to it
+func (m *SSHManager) Register(config SSHHost) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.hosts[config.Name] = &managedSSHHost{
+		config: config,
+		status: SSHHostStatus{State: SSHStateDisconnected},
+	}
+}
+
+// SetStateDir sets the directory tofu mode records host keys to
+func (m *SSHManager) SetStateDir(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stateDir = dir
+}
+
+// StateDir returns the directory tofu mode records host keys to
+func (m *SSHManager) StateDir() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.stateDir
+}
+
+// Connect dials a registered host. If the dial fails, the host is marked
+// unreachable and retried in the background until it succeeds.
+func (m *SSHManager) Connect(hostName string) error {
+	if _, err := m.Reconnect(hostName, nil); err != nil {
+		m.retryInBackground(hostName)
+		return err
+	}
+	return nil
+}
+
+// Get returns the current connection for a host, which may be nil if the
+// host is registered but not connected
+func (m *SSHManager) Get(hostName string) (*SSHConnection, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	host, exists := m.hosts[hostName]
+	if !exists {
+		return nil, false
+	}
+	return host.conn, true
+}
+
+// Connection returns a live connection for a host, dialing it if it is dead
+// or hasn't been connected yet. Hosts that are being retried in the
+// background return an error immediately rather than blocking on another dial.
+func (m *SSHManager) Connection(hostName string) (*SSHConnection, error) {
+	conn, exists := m.Get(hostName)
+	if !exists {
+		return nil, fmt.Errorf("SSH host %s not found", hostName)
+	}
+
+	if conn == nil && m.isRetrying(hostName) {
+		status, _ := m.Status(hostName)
+		return nil, fmt.Errorf("SSH host %s is unreachable: %v", hostName, status.LastError)
+	}
+
+	if conn != nil {
+		if m.alive(conn) {
+			return conn, nil
+		}
+		logger.Warnf("SSH connection to %s is dead, reconnecting...", hostName)
+	}
+
+	// Either the connection died or the host hasn't been dialed yet, which
+	// happens when a host behind a jump host connects before the jump host
+	newConn, err := m.Reconnect(hostName, conn)
+	if err != nil {
+		m.retryInBackground(hostName)
+		return nil, fmt.Errorf("SSH host %s is unreachable: %v", hostName, err)
+	}
+	return newConn, nil
+}
+
+// Reconnect replaces a host's connection. stale is the connection the caller
+// found to be dead; if another goroutine has already replaced it, the newer
+// connection is returned without dialing again. Concurrent calls for the
+// same host share one dial.
+func (m *SSHManager) Reconnect(hostName string, stale *SSHConnection) (*SSHConnection, error) {
+	result, err, _ := m.dials.Do(hostName, func() (interface{}, error) {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return nil, fmt.Errorf("SSH manager closed")
+		}
+		host, exists := m.hosts[hostName]
+		if !exists {
+			m.mu.Unlock()
+			return nil, fmt.Errorf("SSH host %s not found", hostName)
+		}
+		if host.conn != nil && host.conn != stale {
+			current := host.conn
+			m.mu.Unlock()
+			return current, nil
+		}
+		config := host.config
+		m.setStateLocked(host, SSHStateConnecting, nil)
+		m.mu.Unlock()
+
+		newConn, dialErr := m.dial(config)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		// Close ran while we were dialing, so nothing would ever close this
+		if m.closed {
+			if newConn != nil && newConn.client != nil {
+				newConn.client.Close()
+			}
+			return nil, fmt.Errorf("SSH manager closed")
+		}
+
+		if dialErr != nil {
+			// Drop the dead connection so the retry loop dials again and
+			// Connection fails fast instead of handing it out
+			if host.conn != nil && host.conn.client != nil {
+				host.conn.client.Close()
+			}
+			host.conn = nil
+			m.setStateLocked(host, SSHStateUnreachable, dialErr)
+			return nil, dialErr
+		}
+
+		old := host.conn
+		host.conn = newConn
+		m.setStateLocked(host, SSHStateConnected, nil)
+
+		if old != nil && old.client != nil {
+			old.client.Close()
+		}
+
+		logger.Infof("Connected to SSH host: %s", hostName)
+		return newConn, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*SSHConnection), nil
+}
+
+// Status returns the connection state of a single host
+func (m *SSHManager) Status(hostName string) (SSHHostStatus, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	host, exists := m.hosts[hostName]
+	if !exists {
+		return SSHHostStatus{}, false
+	}
+	return host.status, true
+}
+
+// isRetrying reports whether a background retry loop is running for a host
+func (m *SSHManager) isRetrying(hostName string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	host, exists := m.hosts[hostName]
+	return exists && host.retrying
+}
+
+// retryInBackground keeps dialing an unreachable host with exponential
+// backoff until it connects or the manager is closed. Only one retry loop
+// runs per host.
+func (m *SSHManager) retryInBackground(hostName string) {
+	m.mu.Lock()
+	host, exists := m.hosts[hostName]
+	if !exists || host.retrying || m.closed {
+		m.mu.Unlock()
+		return
+	}
+	host.retrying = true
+	m.mu.Unlock()
+
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			host.retrying = false
+			m.mu.Unlock()
+		}()
+
+		for attempt := 0; ; attempt++ {
+			delay := m.retryDelay(attempt)
+			logger.Infof("Retrying SSH host %s in %s", hostName, delay.Round(time.Second))
+
+			select {
+			case <-time.After(delay):
+			case <-m.stop:
+				return
+			}
+
+			if _, err := m.Reconnect(hostName, nil); err != nil {
+				logger.Warnf("SSH host %s still unreachable (attempt %d): %v", hostName, attempt+1, err)
+				continue
+			}
+			return
+		}
+	}()
+}
+
+// sshRetryDelay returns the backoff for the given attempt, doubling from
+// sshRetryInitialDelay up to sshRetryMaxDelay with +/-20% jitter
+func sshRetryDelay(attempt int) time.Duration {
+	delay := sshRetryInitialDelay
+	for i := 0; i < attempt && delay < sshRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > sshRetryMaxDelay {
+		delay = sshRetryMaxDelay
+	}
+
+	jitter := time.Duration(float64(delay) * (rand.Float64()*0.4 - 0.2))
+	return delay + jitter
+}
+
+// Close stops background retries and closes every managed connection
+func (m *SSHManager) Close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	for name, host := range m.hosts {
+		if host.conn != nil && host.conn.client != nil {
+			host.conn.client.Close()
+			logger.Infof("Closed SSH connection to: %s", name)
+		}
+		host.conn = nil
+		m.setStateLocked(host, SSHStateDisconnected, nil)
+	}
+}
+
+// setStateLocked records a state transition; m.mu must be held
+func (m *SSHManager) setStateLocked(host *managedSSHHost, state SSHConnectionState, err error) {
+	if host.status.State != state {
+		logger.Debugf("SSH host %s: %s -> %s", host.config.Name, host.status.State, state)
+	}
+	host.status.State = state
+	host.status.LastError = err
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubDialer replaces the manager's dialer. Each dial returns a new
+// connection unless fail is set, and waits for release when it's non-nil.
+type stubDialer struct {
+	mu      sync.Mutex
+	dials   int
+	fail    bool
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *stubDialer) dial(config SSHHost) (*SSHConnection, error) {
+	d.mu.Lock()
+	d.dials++
+	fail := d.fail
+	started, release := d.started, d.release
+	d.mu.Unlock()
+
+	if started != nil {
+		started <- struct{}{}
+	}
+	if release != nil {
+		<-release
+	}
+	if fail {
+		return nil, errors.New("connection refused")
+	}
+	return &SSHConnection{config: config}, nil
+}
+
+func (d *stubDialer) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+func (d *stubDialer) setFail(fail bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.fail = fail
+}
+
+// newStubManager returns a manager with one registered host whose dials go
+// to the stub and whose connections are alive only if set in alive
+func newStubManager(t *testing.T, dialer *stubDialer, alive map[*SSHConnection]bool) *SSHManager {
+	t.Helper()
+	quietLogger(t)
+
+	m := NewSSHManager()
+	m.dial = dialer.dial
+	var aliveMu sync.Mutex
+	m.alive = func(conn *SSHConnection) bool {
+		aliveMu.Lock()
+		defer aliveMu.Unlock()
+		return alive[conn]
+	}
+	m.retryDelay = func(int) time.Duration { return time.Millisecond }
+	m.Register(SSHHost{Name: "nas"})
+	t.Cleanup(m.Close)
+	return m
+}
+
+func TestSSHManagerReconnectCoalesces(t *testing.T) {
+	dialer := &stubDialer{started: make(chan struct{}, 1), release: make(chan struct{})}
+	m := newStubManager(t, dialer, nil)
+
+	const callers = 10
+	results := make(chan *SSHConnection, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := m.Reconnect("nas", nil)
+			if err != nil {
+				t.Errorf("Reconnect() error = %v", err)
+			}
+			results <- conn
+		}()
+	}
+
+	// Hold the first dial open while the other callers pile up behind it
+	<-dialer.started
+	time.Sleep(10 * time.Millisecond)
+	close(dialer.release)
+	wg.Wait()
+	close(results)
+
+	if got := dialer.count(); got != 1 {
+		t.Errorf("dials = %d, want 1", got)
+	}
+	first := <-results
+	for conn := range results {
+		if conn != first {
+			t.Errorf("Reconnect() returned different connections %p and %p", first, conn)
+		}
+	}
+	if current, _ := m.Get("nas"); current != first {
+		t.Errorf("Get() = %p, want %p", current, first)
+	}
+}
+
+func TestSSHManagerReconnectStale(t *testing.T) {
+	dialer := &stubDialer{}
+	m := newStubManager(t, dialer, nil)
+
+	current, err := m.Reconnect("nas", nil)
+	if err != nil {
+		t.Fatalf("Reconnect() error = %v", err)
+	}
+
+	// Another goroutine already replaced the connection this caller saw die
+	stale := &SSHConnection{}
+	if conn, err := m.Reconnect("nas", stale); err != nil || conn != current {
+		t.Errorf("Reconnect(stale) = %p, %v, want %p", conn, err, current)
+	}
+	if got := dialer.count(); got != 1 {
+		t.Errorf("dials after a stale reconnect = %d, want 1", got)
+	}
+
+	// The current connection itself died, so it is replaced
+	replacement, err := m.Reconnect("nas", current)
+	if err != nil {
+		t.Fatalf("Reconnect(current) error = %v", err)
+	}
+	if replacement == current {
+		t.Error("Reconnect(current) returned the dead connection")
+	}
+	if got := dialer.count(); got != 2 {
+		t.Errorf("dials = %d, want 2", got)
+	}
+
+	if _, err := m.Reconnect("unknown", nil); err == nil {
+		t.Error("Reconnect() of an unregistered host succeeded")
+	}
+}
+
+func TestSSHManagerConnection(t *testing.T) {
+	dialer := &stubDialer{}
+	alive := make(map[*SSHConnection]bool)
+	m := newStubManager(t, dialer, alive)
+
+	// Not dialed yet, so Connection dials
+	conn, err := m.Connection("nas")
+	if err != nil {
+		t.Fatalf("Connection() error = %v", err)
+	}
+	if status, _ := m.Status("nas"); status.State != SSHStateConnected {
+		t.Errorf("state = %s, want %s", status.State, SSHStateConnected)
+	}
+
+	// A dead connection is replaced
+	replacement, err := m.Connection("nas")
+	if err != nil || replacement == conn {
+		t.Fatalf("Connection() with a dead connection = %p, %v, want a new connection", replacement, err)
+	}
+
+	// A live connection is handed out as is
+	alive[replacement] = true
+	if got, err := m.Connection("nas"); err != nil || got != replacement {
+		t.Errorf("Connection() = %p, %v, want %p", got, err, replacement)
+	}
+	if got := dialer.count(); got != 2 {
+		t.Errorf("dials = %d, want 2", got)
+	}
+
+	if _, err := m.Connection("unknown"); err == nil {
+		t.Error("Connection() of an unregistered host succeeded")
+	}
+}
+
+func TestSSHManagerRetryInBackground(t *testing.T) {
+	dialer := &stubDialer{fail: true}
+	m := newStubManager(t, dialer, nil)
+
+	// Hold retries until the host has been checked, then count retry loops
+	// by how many are sleeping at once
+	gate := make(chan struct{})
+	var sleeping, maxSleeping int32
+	m.retryDelay = func(int) time.Duration {
+		<-gate
+		n := atomic.AddInt32(&sleeping, 1)
+		for {
+			max := atomic.LoadInt32(&maxSleeping)
+			if n <= max || atomic.CompareAndSwapInt32(&maxSleeping, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&sleeping, -1)
+		return 0
+	}
+
+	if err := m.Connect("nas"); err == nil {
+		t.Fatal("Connect() to an unreachable host succeeded")
+	}
+	for i := 0; i < 5; i++ {
+		m.retryInBackground("nas")
+	}
+	if _, err := m.Connection("nas"); err == nil {
+		t.Error("Connection() while retrying succeeded")
+	}
+	if status, _ := m.Status("nas"); status.State != SSHStateUnreachable || status.LastError == nil {
+		t.Errorf("status = %+v, want unreachable with an error", status)
+	}
+	close(gate)
+
+	waitFor(t, "a few retries", func() bool { return dialer.count() >= 4 })
+	dialer.setFail(false)
+	waitFor(t, "the retry loop to connect", func() bool { return !m.isRetrying("nas") })
+
+	if conn, _ := m.Get("nas"); conn == nil {
+		t.Error("Get() after a successful retry = nil")
+	}
+	if got := atomic.LoadInt32(&maxSleeping); got != 1 {
+		t.Errorf("%d retry loops ran at once, want 1", got)
+	}
+}
+
+func TestSSHManagerCloseStopsRetries(t *testing.T) {
+	dialer := &stubDialer{fail: true}
+	m := newStubManager(t, dialer, nil)
+	m.retryDelay = func(int) time.Duration { return time.Hour }
+
+	m.Connect("nas")
+	if !m.isRetrying("nas") {
+		t.Fatal("no retry loop after a failed Connect()")
+	}
+
+	m.Close()
+	waitFor(t, "the retry loop to stop", func() bool { return !m.isRetrying("nas") })
+
+	m.retryInBackground("nas")
+	if m.isRetrying("nas") {
+		t.Error("retryInBackground() started a loop after Close()")
+	}
+}
+
+func TestSSHManagerCloseDuringDial(t *testing.T) {
+	dialer := &stubDialer{started: make(chan struct{}, 1), release: make(chan struct{})}
+	m := newStubManager(t, dialer, nil)
+
+	errs := make(chan error, 1)
+	go func() { errs <- m.Connect("nas") }()
+
+	<-dialer.started
+	m.Close()
+	close(dialer.release)
+
+	if err := <-errs; err == nil {
+		t.Error("Connect() finishing after Close() succeeded")
+	}
+	if conn, _ := m.Get("nas"); conn != nil {
+		t.Error("a connection dialed during Close() was stored")
+	}
+	if m.isRetrying("nas") {
+		t.Error("a retry loop started after Close()")
+	}
+	if _, err := m.Reconnect("nas", nil); err == nil {
+		t.Error("Reconnect() after Close() succeeded")
+	}
+	if got := dialer.count(); got != 1 {
+		t.Errorf("dials = %d, want 1", got)
+	}
+}
+
+func TestSSHRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		base    time.Duration
+	}{
+		{0, sshRetryInitialDelay},
+		{1, 2 * sshRetryInitialDelay},
+		{2, 4 * sshRetryInitialDelay},
+		{5, 32 * sshRetryInitialDelay},
+		{6, sshRetryMaxDelay},
+		{100, sshRetryMaxDelay},
+	}
+
+	for _, tt := range tests {
+		low := time.Duration(float64(tt.base) * 0.8)
+		high := time.Duration(float64(tt.base) * 1.2)
+		for i := 0; i < 50; i++ {
+			if got := sshRetryDelay(tt.attempt); got < low || got > high {
+				t.Errorf("sshRetryDelay(%d) = %s, want within [%s, %s]", tt.attempt, got, low, high)
+				break
+			}
+		}
+	}
+}
+
+// waitFor polls condition until it holds or a second has passed
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
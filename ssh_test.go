@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestValidateJumpHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   []SSHHost
+		wantErr bool
+	}{
+		{"no jump hosts", []SSHHost{{Name: "a"}, {Name: "b"}}, false},
+		{"single hop", []SSHHost{{Name: "a", JumpHost: "bastion"}, {Name: "bastion"}}, false},
+		{"multi-hop chain", []SSHHost{
+			{Name: "target", JumpHost: "inner"},
+			{Name: "inner", JumpHost: "outer"},
+			{Name: "outer", JumpHost: "edge"},
+			{Name: "edge"},
+		}, false},
+		{"shared bastion", []SSHHost{
+			{Name: "a", JumpHost: "bastion"},
+			{Name: "b", JumpHost: "bastion"},
+			{Name: "bastion"},
+		}, false},
+		{"unknown jump host", []SSHHost{{Name: "a", JumpHost: "missing"}}, true},
+		{"unknown hop deep in a chain", []SSHHost{
+			{Name: "target", JumpHost: "inner"},
+			{Name: "inner", JumpHost: "missing"},
+		}, true},
+		{"host is its own jump host", []SSHHost{{Name: "a", JumpHost: "a"}}, true},
+		{"two-host cycle", []SSHHost{{Name: "a", JumpHost: "b"}, {Name: "b", JumpHost: "a"}}, true},
+		{"cycle further down the chain", []SSHHost{
+			{Name: "target", JumpHost: "a"},
+			{Name: "a", JumpHost: "b"},
+			{Name: "b", JumpHost: "c"},
+			{Name: "c", JumpHost: "a"},
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateJumpHosts(tt.hosts); (err != nil) != tt.wantErr {
+				t.Errorf("validateJumpHosts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// stubJumpDialer hands out one end of a pipe after delay
+type stubJumpDialer struct {
+	delay  time.Duration
+	err    error
+	dialed chan net.Conn
+}
+
+func (d *stubJumpDialer) Dial(_, _ string) (net.Conn, error) {
+	time.Sleep(d.delay)
+	if d.err != nil {
+		return nil, d.err
+	}
+	conn, peer := net.Pipe()
+	d.dialed <- peer
+	return conn, nil
+}
+
+func TestDialViaJumpHost(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		err     error
+		timeout time.Duration
+		wantErr bool
+	}{
+		{"within the timeout", 0, nil, time.Second, false},
+		{"no timeout", 20 * time.Millisecond, nil, 0, false},
+		{"dial error", 0, errors.New("administratively prohibited"), time.Second, true},
+		{"times out", 200 * time.Millisecond, nil, 20 * time.Millisecond, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := &stubJumpDialer{delay: tt.delay, err: tt.err, dialed: make(chan net.Conn, 1)}
+
+			conn, err := dialViaJumpHost(dialer, "10.0.0.1:22", tt.timeout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialViaJumpHost() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			if tt.err != nil {
+				return
+			}
+
+			// A connection that arrives after the timeout is closed, so the
+			// far end sees EOF instead of a leaked channel
+			peer := <-dialer.dialed
+			if tt.wantErr {
+				peer.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := peer.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+					t.Errorf("reading a late connection error = %v, want EOF", err)
+				}
+			}
+			peer.Close()
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sshConfigBlock is a Host section from an OpenSSH client config file
+type sshConfigBlock struct {
+	patterns []string
+	options  map[string]string // lowercased keyword -> first value
+}
+
+// sshClientConfig is a parsed OpenSSH client config file
+type sshClientConfig struct {
+	blocks []sshConfigBlock
+}
+
+// importSSHConfigHosts merges hosts from the OpenSSH client config named by
+// ssh.config_file into ssh.hosts. Unless ssh.import_hosts lists them, only
+// the aliases commands use as target_host are imported, along with their
+// jump hosts. Hosts defined in YAML keep every field they set and only take
+// missing fields from the client config, importing any jump host they pick
+// up that way.
+func importSSHConfigHosts(config *SSHConfig, commands []CommandConfig) error {
+	if config.ConfigFile == "" {
+		return nil
+	}
+
+	configPath, err := expandHome(config.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	clientConfig, err := parseSSHClientConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	aliases := config.ImportHosts
+	if len(aliases) == 0 {
+		aliases = targetAliases(clientConfig, commands)
+	}
+
+	// YAML hosts pick up matching blocks too, and may inherit a ProxyJump
+	// from a wildcard block whose jump hosts then need importing
+	yamlHosts := make(map[string]int, len(config.Hosts))
+	for i, host := range config.Hosts {
+		yamlHosts[host.Name] = i
+		aliases = append(aliases, host.Name)
+	}
+
+	// Jump hosts named by ProxyJump are imported too, so queue them up as
+	// they're discovered. In a chain "a,b" each hop is reached through the
+	// one before it, unless the hop names a jump host of its own.
+	imported := 0
+	seen := make(map[string]bool)
+	previousHop := make(map[string]string)
+	for len(aliases) > 0 {
+		alias := aliases[0]
+		aliases = aliases[1:]
+		if seen[alias] {
+			continue
+		}
+		seen[alias] = true
+
+		host := clientConfig.host(alias)
+		hops := clientConfig.proxyJumpHops(alias)
+		if i, exists := yamlHosts[alias]; exists && config.Hosts[i].JumpHost != "" {
+			// The YAML jump_host wins, so the ProxyJump chain is never used
+			hops = nil
+		}
+		for i, hop := range hops {
+			if i > 0 && previousHop[hop] == "" {
+				previousHop[hop] = hops[i-1]
+			}
+			aliases = append(aliases, hop)
+		}
+
+		if i, exists := yamlHosts[alias]; exists {
+			config.Hosts[i] = mergeSSHHost(config.Hosts[i], host)
+			continue
+		}
+
+		config.Hosts = append(config.Hosts, host)
+		imported++
+	}
+
+	for i, host := range config.Hosts {
+		if host.JumpHost == "" {
+			config.Hosts[i].JumpHost = previousHop[host.Name]
+		}
+	}
+
+	logger.Infof("Imported %d SSH host(s) from %s", imported, configPath)
+	return nil
+}
+
+// parseSSHClientConfig reads the Host blocks of an OpenSSH client config
+// file. Match blocks and Include directives are not supported and skipped.
+func parseSSHClientConfig(filename string) (*sshClientConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSH config file %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	// Options before the first Host line apply to every host
+	current := &sshConfigBlock{patterns: []string{"*"}, options: make(map[string]string)}
+	clientConfig := &sshClientConfig{}
+	skipping := false
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyword, args := splitSSHConfigLine(line)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s:%d: missing value for %s", filename, lineNumber, keyword)
+		}
+
+		switch keyword {
+		case "host":
+			clientConfig.blocks = append(clientConfig.blocks, *current)
+			current = &sshConfigBlock{patterns: args, options: make(map[string]string)}
+			skipping = false
+		case "match":
+			logger.Debugf("%s:%d: Match blocks are not supported, skipping", filename, lineNumber)
+			skipping = true
+		case "include":
+			logger.Debugf("%s:%d: Include is not supported, skipping", filename, lineNumber)
+		default:
+			// The first value seen for a keyword wins, as in OpenSSH
+			if _, exists := current.options[keyword]; !exists && !skipping {
+				current.options[keyword] = strings.Join(args, " ")
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read SSH config file %s: %v", filename, err)
+	}
+
+	clientConfig.blocks = append(clientConfig.blocks, *current)
+	return clientConfig, nil
+}
+
+// splitSSHConfigLine splits "Keyword value" or "Keyword=value" into a
+// lowercased keyword and its arguments, honouring double quotes
+func splitSSHConfigLine(line string) (string, []string) {
+	keyword := line
+	rest := ""
+	if i := strings.IndexAny(line, " \t="); i >= 0 {
+		keyword = line[:i]
+		rest = strings.TrimLeft(line[i:], " \t")
+		rest = strings.TrimPrefix(rest, "=")
+	}
+
+	var args []string
+	var arg strings.Builder
+	inQuotes := false
+	hasArg := false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			hasArg = true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if hasArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				hasArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			hasArg = true
+		}
+	}
+	if hasArg {
+		args = append(args, arg.String())
+	}
+
+	return strings.ToLower(keyword), args
+}
+
+// aliases returns every concrete (non-wildcard, non-negated) Host alias
+func (c *sshClientConfig) aliases() []string {
+	var aliases []string
+	for _, block := range c.blocks {
+		for _, pattern := range block.patterns {
+			if !strings.ContainsAny(pattern, "*?!") {
+				aliases = append(aliases, pattern)
+			}
+		}
+	}
+	return aliases
+}
+
+// targetAliases returns the command target_host values the client config
+// defines, either as a literal Host alias or through a wildcard block, so
+// hosts nothing runs on aren't dialed. Catch-all "*" blocks don't count, or
+// every target would be imported whether the config describes it or not.
+func targetAliases(c *sshClientConfig, commands []CommandConfig) []string {
+	literal := make(map[string]bool)
+	for _, alias := range c.aliases() {
+		literal[alias] = true
+	}
+
+	var aliases []string
+	seen := make(map[string]bool)
+	for _, cmd := range commands {
+		target := cmd.TargetHost
+		if target == "" || target == "local" || seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		if literal[target] || c.matchesSpecificBlock(target) {
+			aliases = append(aliases, target)
+		}
+	}
+	return aliases
+}
+
+// matchesSpecificBlock reports whether alias matches a Host block other than
+// a catch-all "*" block
+func (c *sshClientConfig) matchesSpecificBlock(alias string) bool {
+	for _, block := range c.blocks {
+		if !block.catchAll() && block.matches(alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the first value for keyword across every block matching alias
+func (c *sshClientConfig) get(alias, keyword string) string {
+	for _, block := range c.blocks {
+		if !block.matches(alias) {
+			continue
+		}
+		if value, exists := block.options[keyword]; exists {
+			return value
+		}
+	}
+	return ""
+}
+
+// host resolves the fields createSSHConnection uses for alias
+func (c *sshClientConfig) host(alias string) SSHHost {
+	host := SSHHost{
+		Name: alias,
+		Host: alias,
+		User: c.get(alias, "user"),
+	}
+
+	// Default the user before expanding IdentityFile so %r has a value
+	if host.User == "" {
+		if current, err := user.Current(); err == nil {
+			host.User = current.Username
+		}
+	}
+
+	if hostName := c.get(alias, "hostname"); hostName != "" {
+		host.Host = strings.ReplaceAll(hostName, "%h", alias)
+	}
+
+	if port := c.get(alias, "port"); port != "" {
+		if portNumber, err := strconv.Atoi(port); err == nil {
+			host.Port = portNumber
+		} else {
+			logger.Warnf("Invalid Port %q for SSH config host %s", port, alias)
+		}
+	}
+
+	if identityFile := c.get(alias, "identityfile"); identityFile != "" {
+		host.KeyPath = expandSSHConfigPath(identityFile, host)
+	}
+
+	if timeout := c.get(alias, "connecttimeout"); timeout != "" {
+		host.Timeout = timeout + "s"
+	}
+
+	// The last hop of a ProxyJump chain is the direct jump host; the hops
+	// before it are chained together by importSSHConfigHosts
+	if hops := c.proxyJumpHops(alias); len(hops) > 0 {
+		host.JumpHost = hops[len(hops)-1]
+	}
+
+	return host
+}
+
+// proxyJumpHops returns the hops of alias's ProxyJump in connection order.
+// Hops must be Host aliases; a chain with a user@host:port hop is ignored.
+func (c *sshClientConfig) proxyJumpHops(alias string) []string {
+	proxyJump := c.get(alias, "proxyjump")
+	if proxyJump == "" || strings.EqualFold(proxyJump, "none") {
+		return nil
+	}
+
+	var hops []string
+	for _, hop := range strings.Split(proxyJump, ",") {
+		hop = strings.TrimSpace(hop)
+		if hop == "" || strings.ContainsAny(hop, "@:") {
+			logger.Warnf("SSH config host %s uses ProxyJump %s; only Host aliases are supported as jump hosts", alias, proxyJump)
+			return nil
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// matches reports whether alias matches the block's Host patterns
+func (b sshConfigBlock) matches(alias string) bool {
+	matched := false
+	for _, pattern := range b.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), alias); !ok {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// catchAll reports whether the block applies to every host
+func (b sshConfigBlock) catchAll() bool {
+	for _, pattern := range b.patterns {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// expandSSHConfigPath expands ~ and the %d, %h, %r and %% tokens in a path
+func expandSSHConfigPath(value string, host SSHHost) string {
+	homeDir, _ := os.UserHomeDir()
+
+	replacer := strings.NewReplacer("%d", homeDir, "%h", host.Host, "%r", host.User, "%%", "%")
+	expanded, err := expandHome(replacer.Replace(value))
+	if err != nil {
+		return value
+	}
+	return expanded
+}
+
+// mergeSSHHost fills the fields override leaves empty from base
+func mergeSSHHost(override, base SSHHost) SSHHost {
+	merged := override
+	if merged.Host == "" {
+		merged.Host = base.Host
+	}
+	if merged.Port == 0 {
+		merged.Port = base.Port
+	}
+	if merged.User == "" {
+		merged.User = base.User
+	}
+	if merged.KeyPath == "" {
+		merged.KeyPath = base.KeyPath
+	}
+	if merged.Timeout == "" {
+		merged.Timeout = base.Timeout
+	}
+	if merged.JumpHost == "" {
+		merged.JumpHost = base.JumpHost
+	}
+	return merged
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testSSHConfig = `# Options before the first Host apply to every host
+User default
+
+Host nas
+  HostName 192.168.1.10
+  Port 2222
+  IdentityFile ~/.ssh/nas_%h
+  ConnectTimeout 5
+
+Host router router-alias
+  HostName=10.0.0.1
+  User "admin user"
+
+Host *.example.com !bad.example.com
+  User web
+  ProxyJump bastion
+
+Host bastion
+  HostName bastion.example.com
+  User jump
+  ProxyJump none
+
+Host inner
+  HostName 10.1.0.1
+  ProxyJump bastion
+
+Host db
+  HostName 10.2.0.1
+  ProxyJump bastion, inner
+
+Host raw
+  ProxyJump admin@jump.example.com:2222
+
+Host first
+  Port 1000
+  Port 2000
+
+Match all
+  HostName matched.example.com
+  Port 9999
+
+Host *
+  User fallback
+  Port 22
+`
+
+// writeSSHConfig writes content to a temporary config file and returns its path
+func writeSSHConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func quietLogger(t *testing.T) {
+	t.Helper()
+
+	previous := logger
+	logger = logrus.New()
+	logger.SetOutput(io.Discard)
+	t.Cleanup(func() { logger = previous })
+}
+
+func TestSSHConfigBlockMatches(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		alias    string
+		want     bool
+	}{
+		{[]string{"nas"}, "nas", true},
+		{[]string{"nas"}, "nas2", false},
+		{[]string{"*"}, "anything", true},
+		{[]string{"web?"}, "web1", true},
+		{[]string{"web?"}, "web10", false},
+		{[]string{"*.example.com"}, "www.example.com", true},
+		{[]string{"*.example.com", "!bad.example.com"}, "www.example.com", true},
+		{[]string{"*.example.com", "!bad.example.com"}, "bad.example.com", false},
+		{[]string{"!bad.example.com", "*.example.com"}, "bad.example.com", false},
+		{[]string{"!bad.example.com"}, "www.example.com", false},
+		{[]string{"a", "b"}, "b", true},
+	}
+
+	for _, tt := range tests {
+		block := sshConfigBlock{patterns: tt.patterns}
+		if got := block.matches(tt.alias); got != tt.want {
+			t.Errorf("patterns %q matches(%q) = %v, want %v", tt.patterns, tt.alias, got, tt.want)
+		}
+	}
+}
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		wantKeyword string
+		wantArgs    []string
+	}{
+		{"HostName example.com", "hostname", []string{"example.com"}},
+		{"Port=2222", "port", []string{"2222"}},
+		{"Port = 2222", "port", []string{"2222"}},
+		{"Host a b\tc", "host", []string{"a", "b", "c"}},
+		{`IdentityFile "~/my keys/id"`, "identityfile", []string{"~/my keys/id"}},
+		{`User ""`, "user", []string{""}},
+		{"Compression", "compression", nil},
+	}
+
+	for _, tt := range tests {
+		keyword, args := splitSSHConfigLine(tt.line)
+		if keyword != tt.wantKeyword || !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("splitSSHConfigLine(%q) = %q, %q, want %q, %q", tt.line, keyword, args, tt.wantKeyword, tt.wantArgs)
+		}
+	}
+}
+
+func TestSSHClientConfigHost(t *testing.T) {
+	quietLogger(t)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	clientConfig, err := parseSSHClientConfig(writeSSHConfig(t, testSSHConfig))
+	if err != nil {
+		t.Fatalf("parseSSHClientConfig() error = %v", err)
+	}
+
+	tests := []struct {
+		alias string
+		want  SSHHost
+	}{
+		{"nas", SSHHost{Name: "nas", Host: "192.168.1.10", Port: 2222, User: "default",
+			KeyPath: filepath.Join(home, ".ssh/nas_192.168.1.10"), Timeout: "5s"}},
+		{"router-alias", SSHHost{Name: "router-alias", Host: "10.0.0.1", Port: 22, User: "default"}},
+		{"www.example.com", SSHHost{Name: "www.example.com", Host: "www.example.com", Port: 22, User: "default", JumpHost: "bastion"}},
+		{"bad.example.com", SSHHost{Name: "bad.example.com", Host: "bad.example.com", Port: 22, User: "default"}},
+		{"bastion", SSHHost{Name: "bastion", Host: "bastion.example.com", Port: 22, User: "default"}},
+		{"db", SSHHost{Name: "db", Host: "10.2.0.1", Port: 22, User: "default", JumpHost: "inner"}},
+		{"raw", SSHHost{Name: "raw", Host: "raw", Port: 22, User: "default"}},
+		{"first", SSHHost{Name: "first", Host: "first", Port: 1000, User: "default"}},
+		{"unknown", SSHHost{Name: "unknown", Host: "unknown", Port: 22, User: "default"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.alias, func(t *testing.T) {
+			if got := clientConfig.host(tt.alias); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("host(%q) = %+v, want %+v", tt.alias, got, tt.want)
+			}
+		})
+	}
+
+	// Without a User option %r expands to the current user
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("user.Current() error = %v", err)
+	}
+	noUserConfig, err := parseSSHClientConfig(writeSSHConfig(t, "Host nouser\n  IdentityFile ~/.ssh/%r_key\n"))
+	if err != nil {
+		t.Fatalf("parseSSHClientConfig() error = %v", err)
+	}
+	want := SSHHost{Name: "nouser", Host: "nouser", User: current.Username,
+		KeyPath: filepath.Join(home, ".ssh", current.Username+"_key")}
+	if got := noUserConfig.host("nouser"); !reflect.DeepEqual(got, want) {
+		t.Errorf("host(%q) = %+v, want %+v", "nouser", got, want)
+	}
+}
+
+func TestSSHClientConfigProxyJumpHops(t *testing.T) {
+	quietLogger(t)
+
+	clientConfig, err := parseSSHClientConfig(writeSSHConfig(t, testSSHConfig))
+	if err != nil {
+		t.Fatalf("parseSSHClientConfig() error = %v", err)
+	}
+
+	tests := []struct {
+		alias string
+		want  []string
+	}{
+		{"inner", []string{"bastion"}},
+		{"db", []string{"bastion", "inner"}},
+		{"www.example.com", []string{"bastion"}},
+		{"bastion", nil},
+		{"raw", nil},
+		{"nas", nil},
+	}
+
+	for _, tt := range tests {
+		if got := clientConfig.proxyJumpHops(tt.alias); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("proxyJumpHops(%q) = %q, want %q", tt.alias, got, tt.want)
+		}
+	}
+}
+
+func TestParseSSHClientConfigErrors(t *testing.T) {
+	quietLogger(t)
+
+	if _, err := parseSSHClientConfig(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("parseSSHClientConfig() of a missing file succeeded")
+	}
+	if _, err := parseSSHClientConfig(writeSSHConfig(t, "Host nas\n  HostName\n")); err == nil {
+		t.Error("parseSSHClientConfig() with a missing value succeeded")
+	}
+}
+
+func TestImportSSHConfigHosts(t *testing.T) {
+	quietLogger(t)
+	t.Setenv("HOME", t.TempDir())
+	filename := writeSSHConfig(t, testSSHConfig)
+
+	tests := []struct {
+		name     string
+		config   SSHConfig
+		commands []CommandConfig
+		want     map[string]SSHHost
+	}{
+		{
+			name:     "only command targets and their jump hosts",
+			config:   SSHConfig{ConfigFile: filename},
+			commands: []CommandConfig{{Name: "a", TargetHost: "db"}, {Name: "b"}, {Name: "c", TargetHost: "local"}},
+			want: map[string]SSHHost{
+				"db":      {Name: "db", Host: "10.2.0.1", Port: 22, User: "default", JumpHost: "inner"},
+				"inner":   {Name: "inner", Host: "10.1.0.1", Port: 22, User: "default", JumpHost: "bastion"},
+				"bastion": {Name: "bastion", Host: "bastion.example.com", Port: 22, User: "default"},
+			},
+		},
+		{
+			name: "multi-hop chain",
+			config: SSHConfig{ConfigFile: writeSSHConfig(t, `Host target
+  HostName 10.0.0.5
+  User u
+  ProxyJump a,b
+Host a
+  User u
+Host b
+  User u
+`)},
+			commands: []CommandConfig{{Name: "x", TargetHost: "target"}},
+			want: map[string]SSHHost{
+				"target": {Name: "target", Host: "10.0.0.5", User: "u", JumpHost: "b"},
+				"a":      {Name: "a", Host: "a", User: "u"},
+				"b":      {Name: "b", Host: "b", User: "u", JumpHost: "a"},
+			},
+		},
+		{
+			name:     "targets covered only by a wildcard block",
+			config:   SSHConfig{ConfigFile: filename},
+			commands: []CommandConfig{{Name: "a", TargetHost: "www.example.com"}, {Name: "b", TargetHost: "unknown"}},
+			want: map[string]SSHHost{
+				"www.example.com": {Name: "www.example.com", Host: "www.example.com", Port: 22, User: "default", JumpHost: "bastion"},
+				"bastion":         {Name: "bastion", Host: "bastion.example.com", Port: 22, User: "default"},
+			},
+		},
+		{
+			name: "YAML host inherits a wildcard ProxyJump",
+			config: SSHConfig{ConfigFile: filename, Hosts: []SSHHost{
+				{Name: "web.example.com", Host: "10.3.0.1", User: "deploy"},
+			}},
+			commands: []CommandConfig{{Name: "a"}},
+			want: map[string]SSHHost{
+				"web.example.com": {Name: "web.example.com", Host: "10.3.0.1", Port: 22, User: "deploy", JumpHost: "bastion"},
+				"bastion":         {Name: "bastion", Host: "bastion.example.com", Port: 22, User: "default"},
+			},
+		},
+		{
+			name: "YAML jump_host takes precedence over a wildcard ProxyJump",
+			config: SSHConfig{ConfigFile: filename, Hosts: []SSHHost{
+				{Name: "web.example.com", User: "deploy", JumpHost: "gateway"},
+				{Name: "gateway", Host: "10.4.0.1", User: "me"},
+			}},
+			commands: []CommandConfig{{Name: "a", TargetHost: "web.example.com"}},
+			want: map[string]SSHHost{
+				"web.example.com": {Name: "web.example.com", Host: "web.example.com", Port: 22, User: "deploy", JumpHost: "gateway"},
+				"gateway":         {Name: "gateway", Host: "10.4.0.1", Port: 22, User: "me"},
+			},
+		},
+		{
+			name:     "import_hosts overrides targets",
+			config:   SSHConfig{ConfigFile: filename, ImportHosts: []string{"router"}},
+			commands: []CommandConfig{{Name: "a", TargetHost: "db"}},
+			want: map[string]SSHHost{
+				"router": {Name: "router", Host: "10.0.0.1", Port: 22, User: "default"},
+			},
+		},
+		{
+			name: "YAML fields take precedence",
+			config: SSHConfig{ConfigFile: filename, Hosts: []SSHHost{
+				{Name: "nas", User: "monitor", Port: 22},
+				{Name: "local-only", Host: "10.9.9.9", User: "me"},
+			}},
+			commands: []CommandConfig{{Name: "a", TargetHost: "nas"}},
+			want: map[string]SSHHost{
+				"nas": {Name: "nas", Host: "192.168.1.10", Port: 22, User: "monitor",
+					KeyPath: filepath.Join(os.Getenv("HOME"), ".ssh/nas_192.168.1.10"), Timeout: "5s"},
+				"local-only": {Name: "local-only", Host: "10.9.9.9", Port: 22, User: "me"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := tt.config
+			if err := importSSHConfigHosts(&config, tt.commands); err != nil {
+				t.Fatalf("importSSHConfigHosts() error = %v", err)
+			}
+
+			if err := validateJumpHosts(config.Hosts); err != nil {
+				t.Errorf("validateJumpHosts() error = %v", err)
+			}
+
+			got := make(map[string]SSHHost, len(config.Hosts))
+			for _, host := range config.Hosts {
+				got[host.Name] = host
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("importSSHConfigHosts() hosts = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}